@@ -1,11 +1,17 @@
 package main
 
 import (
+	"fmt"
 	"github.com/cloudboss/ofcourse/ofcourse"
 	"github.com/matthewmcnew/kpack-resource/resource"
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
+	"os"
 )
 
 func main() {
+	if resource.VersionRequested(os.Args[1:]) {
+		fmt.Println(resource.Version)
+		return
+	}
 	ofcourse.Check(&resource.Resource{})
 }
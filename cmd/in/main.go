@@ -1,10 +1,16 @@
 package main
 
 import (
+	"fmt"
 	"github.com/cloudboss/ofcourse/ofcourse"
 	"github.com/matthewmcnew/kpack-resource/resource"
+	"os"
 )
 
 func main() {
+	if resource.VersionRequested(os.Args[1:]) {
+		fmt.Println(resource.Version)
+		return
+	}
 	ofcourse.In(&resource.Resource{})
 }
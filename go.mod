@@ -3,22 +3,14 @@ module github.com/matthewmcnew/kpack-resource
 go 1.13
 
 require (
-	github.com/buildpack/imgutil v0.0.0-20190827204914-36282d0caea7
-	github.com/buildpack/lifecycle v0.4.1-0.20191002130645-029baabfa337
 	github.com/cloudboss/ofcourse v0.2.1
-	github.com/google/go-cmp v0.3.1
 	github.com/google/go-containerregistry v0.0.0-20190910142231-b02d448a3705
 	github.com/pivotal/kpack v0.0.5-0.20191002195055-7da071d519c4
 	github.com/pkg/errors v0.8.1
-	github.com/sclevine/spec v1.2.0
 	github.com/stretchr/testify v1.4.0
-	go.uber.org/zap v1.9.2-0.20180814183419-67bc79d13d15
-	gopkg.in/src-d/go-git-fixtures.v3 v3.5.0
-	gopkg.in/src-d/go-git.v4 v4.13.1
-	gotest.tools v2.2.0+incompatible
+	golang.org/x/net v0.0.0-20190926025831-c00fd9afed17
 	k8s.io/api v0.0.0-20190819141258-3544db3b9e44
 	k8s.io/apimachinery v0.0.0-20190817020851-f2f3a405f61d
 	k8s.io/client-go v0.0.0-20190819141724-e14f31a72a77
-	k8s.io/code-generator v0.0.0-20190612205613-18da4a14b22b
 	knative.dev/pkg v0.0.0-20190927181044-f6eb4a55ec68
 )
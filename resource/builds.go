@@ -0,0 +1,402 @@
+package resource
+
+import (
+	"encoding/json"
+	oc "github.com/cloudboss/ofcourse/ofcourse"
+	buildv1alpha1 "github.com/pivotal/kpack/pkg/apis/build/v1alpha1"
+	"github.com/pkg/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"knative.dev/pkg/apis/duck/v1alpha1"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// listBuilds returns the builds kpack created for the named image, oldest first. Builds are fetched
+// pageSize at a time to bound the size of each response on busy clusters.
+func listBuilds(client ImageClient, namespace, imageName string, pageSize int64) ([]buildv1alpha1.Build, error) {
+	var (
+		builds        []buildv1alpha1.Build
+		continueToken string
+	)
+	for {
+		buildList, err := client.ListBuilds(namespace, v1.ListOptions{
+			LabelSelector: labels.SelectorFromSet(labels.Set{buildv1alpha1.ImageLabel: imageName}).String(),
+			Limit:         pageSize,
+			Continue:      continueToken,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		builds = append(builds, buildList.Items...)
+
+		continueToken = buildList.Continue
+		if continueToken == "" {
+			break
+		}
+	}
+
+	sort.SliceStable(builds, func(i, j int) bool {
+		return buildNumber(&builds[i]) < buildNumber(&builds[j])
+	})
+	return builds, nil
+}
+
+// cancelBuild deletes the numbered build of an image. kpack deletes the build's pod with it, which
+// stops the build.
+func cancelBuild(client ImageClient, namespace, imageName string, number int64) error {
+	buildList, err := client.ListBuilds(namespace, v1.ListOptions{
+		LabelSelector: buildNumberSelector(imageName, number),
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, build := range buildList.Items {
+		if err := client.DeleteBuild(namespace, build.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getNumberedBuild looks up the numbered build of an image. It returns nil without an error when
+// kpack has not created the build yet.
+func getNumberedBuild(client ImageClient, namespace, imageName string, number int64) (*buildv1alpha1.Build, error) {
+	buildList, err := client.ListBuilds(namespace, v1.ListOptions{
+		LabelSelector: buildNumberSelector(imageName, number),
+	})
+	if err != nil || len(buildList.Items) == 0 {
+		return nil, err
+	}
+	return &buildList.Items[0], nil
+}
+
+// buildNumberSelector selects the numbered build of an image by the labels kpack puts on it.
+func buildNumberSelector(imageName string, number int64) string {
+	return labels.SelectorFromSet(labels.Set{
+		buildv1alpha1.ImageLabel:       imageName,
+		buildv1alpha1.BuildNumberLabel: strconv.FormatInt(number, 10),
+	}).String()
+}
+
+// buildNumber reads the build number kpack stamps on each build, or 0 if it is missing.
+func buildNumber(build *buildv1alpha1.Build) int64 {
+	n, err := strconv.ParseInt(build.Labels[buildv1alpha1.BuildNumberLabel], 10, 64)
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+// putTriggerAnnotation marks the builds a put triggered, so Check can leave them out with
+// `ignore_own_triggers`.
+const putTriggerAnnotation = "kpack-resource/triggered-by-put"
+
+// markPutTrigger annotates the numbered build of an image as triggered by a put.
+func markPutTrigger(client ImageClient, namespace, imageName string, number int64) error {
+	build, err := getNumberedBuild(client, namespace, imageName, number)
+	if err != nil {
+		return err
+	}
+	if build == nil {
+		return errors.Errorf("build %d of image %s does not exist", number, imageName)
+	}
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{putTriggerAnnotation: "true"},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = client.PatchBuild(namespace, build.Name, patch)
+	return err
+}
+
+// filterBuilds keeps the builds Check considers: those of the configured source subdirectory that,
+// with `ignore_own_triggers`, no put triggered, and whose reasons pass the `build_reasons` and
+// `ignore_build_reasons` filters.
+func filterBuilds(builds []buildv1alpha1.Build, config *Config) []buildv1alpha1.Build {
+	builds = filterBySubPath(builds, config.SourceSubPath)
+	if !config.IgnoreOwnTriggers && len(config.BuildReasons) == 0 && len(config.IgnoreBuildReasons) == 0 {
+		return builds
+	}
+
+	var filtered []buildv1alpha1.Build
+	for _, build := range builds {
+		if matchesFilters(&build, config) {
+			filtered = append(filtered, build)
+		}
+	}
+	return filtered
+}
+
+// matchesFilters reports whether build passes the `ignore_own_triggers`, `build_reasons`, and
+// `ignore_build_reasons` filters.
+func matchesFilters(build *buildv1alpha1.Build, config *Config) bool {
+	if config.IgnoreOwnTriggers && build.Annotations[putTriggerAnnotation] != "" {
+		return false
+	}
+	return matchesReasons(build, config.BuildReasons, config.IgnoreBuildReasons)
+}
+
+// matchesReasons reports whether any of the reasons kpack gave for a build is in include, when
+// include is set, and whether any is outside ignore. A build for COMMIT,STACK therefore passes
+// `ignore_build_reasons: [STACK]`, since its new commit still matters. A build without a recorded
+// reason has none, so it never passes `build_reasons`.
+func matchesReasons(build *buildv1alpha1.Build, include, ignore []string) bool {
+	var reasons []string
+	if annotation := build.Annotations[buildv1alpha1.BuildReasonAnnotation]; annotation != "" {
+		reasons = strings.Split(annotation, ",")
+	}
+
+	included := len(include) == 0
+	ignored := len(ignore) > 0 && len(reasons) > 0
+	for _, reason := range reasons {
+		reason = strings.ToUpper(strings.TrimSpace(reason))
+		included = included || containsString(include, reason)
+		ignored = ignored && containsString(ignore, reason)
+	}
+	return included && !ignored
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// filterBySubPath keeps the builds of the given source subdirectory.
+func filterBySubPath(builds []buildv1alpha1.Build, subPath string) []buildv1alpha1.Build {
+	if subPath == "" {
+		return builds
+	}
+
+	var filtered []buildv1alpha1.Build
+	for _, build := range builds {
+		if matchesSubPath(build.Spec.Source, subPath) {
+			filtered = append(filtered, build)
+		}
+	}
+	return filtered
+}
+
+// matchesSubPath reports whether source builds the given subdirectory, ignoring leading and
+// trailing slashes. An empty subPath matches any source.
+func matchesSubPath(source buildv1alpha1.SourceConfig, subPath string) bool {
+	return subPath == "" || strings.Trim(source.SubPath, "/") == strings.Trim(subPath, "/")
+}
+
+// trackedValue is what Check compares to decide whether a build is new: the image it produced or,
+// when tracking source, the git revision it was built from.
+func trackedValue(build *buildv1alpha1.Build, track string) string {
+	if track == trackSource {
+		if build.Spec.Source.Git == nil {
+			return ""
+		}
+		return build.Spec.Source.Git.Revision
+	}
+	return build.Status.LatestImage
+}
+
+// sameTracked compares two tracked values. Images are compared with sameImage.
+func sameTracked(a, b, track string) bool {
+	if track == trackImage {
+		return sameImage(a, b)
+	}
+	return a == b
+}
+
+// trackedKey is the version key holding the tracked value.
+func trackedKey(track string) string {
+	if track == trackSource || track == trackSourceResolver {
+		return "revision"
+	}
+	return "ref"
+}
+
+// versionsSince returns a version for every successful build newer than the one old refers to,
+// oldest first, filtered by config.TriggerOn:
+//
+//   - triggerOnRollback, the default, skips builds whose tracked value is the same as the build
+//     before, such as rebuilds of one revision, but reports reverting to an older value.
+//   - triggerOnNew also skips builds whose tracked value any earlier build in the history had, so
+//     reverts and reproducible rebuilds do not trigger. kpack prunes its history, so a value that
+//     was seen long ago may be reported again.
+//   - triggerOnAny reports every build.
+//
+// Only versions strictly newer than old are returned, so when old is the latest version the result
+// is empty. When old is nil or no longer in the history, only the latest successful build is
+// returned.
+//
+// When config tracks several images every version names its image under "image", and old only
+// matches a build of the image it names.
+func versionsSince(builds []buildv1alpha1.Build, old oc.Version, config *Config) []oc.Version {
+	track, tagImage := config.Track, len(config.Images) > 0
+	imageOf := func(build *buildv1alpha1.Build) string {
+		if !tagImage {
+			return ""
+		}
+		return build.Labels[buildv1alpha1.ImageLabel]
+	}
+
+	var successful []buildv1alpha1.Build
+	for _, build := range builds {
+		if build.Status.GetCondition(v1alpha1.ConditionSucceeded).IsTrue() && trackedValue(&build, track) != "" {
+			successful = append(successful, build)
+		}
+	}
+
+	if len(successful) == 0 {
+		return []oc.Version{}
+	}
+
+	oldValue := old[trackedKey(track)]
+	isOld := func(build *buildv1alpha1.Build) bool {
+		return sameTracked(trackedValue(build, track), oldValue, track) && imageOf(build) == old["image"]
+	}
+	// old is found by the build it names, since a later build of the same value, such as a rollback,
+	// is still new. Versions without a build, or whose build was pruned, are found by their value.
+	start, found := len(successful)-1, false
+	for i := len(successful) - 1; i >= 0 && old["build"] != ""; i-- {
+		if successful[i].Name == old["build"] && isOld(&successful[i]) {
+			start, found = i+1, true
+			break
+		}
+	}
+	for i := len(successful) - 1; i >= 0 && !found; i-- {
+		if isOld(&successful[i]) {
+			start, found = i+1, true
+			break
+		}
+	}
+
+	seen := map[string][]string{}
+	for _, build := range successful[:start] {
+		image := imageOf(&build)
+		seen[image] = append(seen[image], trackedValue(&build, track))
+	}
+
+	versions := []oc.Version{}
+	last := map[string]string{old["image"]: oldValue}
+	for _, build := range successful[start:] {
+		image, value := imageOf(&build), trackedValue(&build, track)
+
+		skip := false
+		switch {
+		case !found || config.TriggerOn == triggerOnAny:
+		case config.TriggerOn == triggerOnNew:
+			for _, seenValue := range seen[image] {
+				skip = skip || sameTracked(seenValue, value, track)
+			}
+		default:
+			skip = sameTracked(last[image], value, track)
+		}
+		seen[image] = append(seen[image], value)
+		last[image] = value
+		if skip {
+			continue
+		}
+
+		version := trackedVersion(&build, track)
+		if tagImage {
+			version["image"] = image
+		}
+		// Concourse already has old, so it is never reported again, even when it is the latest.
+		if sameVersion(version, old) {
+			continue
+		}
+		versions = append(versions, version)
+	}
+	return versions
+}
+
+// sameVersion reports whether two versions have the same keys and values.
+func sameVersion(a, b oc.Version) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key, value := range a {
+		if other, ok := b[key]; !ok || other != value {
+			return false
+		}
+	}
+	return true
+}
+
+// previousImage is the image produced by the last successful build before the named one. It is
+// empty when there is no such build, or the named build is not in the history.
+func previousImage(builds []buildv1alpha1.Build, current string) string {
+	previous := ""
+	for _, build := range builds {
+		if build.Name == current {
+			return previous
+		}
+		if build.Status.GetCondition(v1alpha1.ConditionSucceeded).IsTrue() && build.Status.LatestImage != "" {
+			previous = build.Status.LatestImage
+		}
+	}
+	return ""
+}
+
+// sortByCreation orders builds of several images oldest first.
+func sortByCreation(builds []buildv1alpha1.Build) {
+	sort.SliceStable(builds, func(i, j int) bool {
+		return builds[i].CreationTimestamp.Before(&builds[j].CreationTimestamp)
+	})
+}
+
+// buildVersion is the Concourse version for a successful build.
+//
+// The "ref" key is the image reference kpack produced and, unless Check tracks source revisions
+// under "revision", is what decides whether a version is new. "build" and "build_number" identify
+// the kpack build that produced it, and "created" is when kpack created that build, in UTC. All of
+// them are fixed once the build completes, so repeated checks of the same build yield identical
+// versions.
+func buildVersion(build *buildv1alpha1.Build) oc.Version {
+	return oc.Version{
+		"ref":          build.Status.LatestImage,
+		"build":        build.Name,
+		"build_number": strconv.FormatInt(buildNumber(build), 10),
+		"created":      build.CreationTimestamp.UTC().Format(time.RFC3339),
+	}
+}
+
+// trackedVersion is the version Check reports for a successful build: buildVersion, with the source
+// revision under "revision" when Check tracks it.
+func trackedVersion(build *buildv1alpha1.Build, track string) oc.Version {
+	version := buildVersion(build)
+	if track == trackSource {
+		version[trackedKey(track)] = trackedValue(build, track)
+	}
+	return version
+}
+
+// latestVersion is the version of the build an image most recently completed, identical to the one
+// Check reports for it so that Concourse does not record a put's version twice. When the build
+// cannot be read, such as after kpack pruned it, the version is made from the image alone.
+func latestVersion(client ImageClient, namespace string, image *buildv1alpha1.Image, track string) oc.Version {
+	build, err := client.GetBuild(namespace, image.Status.LatestBuildRef)
+	if err != nil {
+		return imageVersion(image)
+	}
+	return trackedVersion(build, track)
+}
+
+// imageVersion is the Concourse version for the build an image most recently completed, for when
+// that build is gone. It lacks the "created" key of buildVersion, which only the build records.
+func imageVersion(image *buildv1alpha1.Image) oc.Version {
+	return oc.Version{
+		"ref":          image.Status.LatestImage,
+		"build":        image.Status.LatestBuildRef,
+		"build_number": strconv.FormatInt(image.Status.BuildCounter, 10),
+	}
+}
@@ -0,0 +1,224 @@
+package resource
+
+import (
+	oc "github.com/cloudboss/ofcourse/ofcourse"
+	buildv1alpha1 "github.com/pivotal/kpack/pkg/apis/build/v1alpha1"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"knative.dev/pkg/apis/duck/v1alpha1"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// testBuild is build number n of image app. It succeeded with ref unless ref is empty, in which
+// case it failed, and was built from revision.
+func testBuild(n int, ref, revision string) buildv1alpha1.Build {
+	build := buildv1alpha1.Build{
+		ObjectMeta: v1.ObjectMeta{
+			Name:      "app-build-" + strconv.Itoa(n) + "-abcde",
+			Namespace: "default",
+			Labels: map[string]string{
+				buildv1alpha1.ImageLabel:       "app",
+				buildv1alpha1.BuildNumberLabel: strconv.Itoa(n),
+			},
+			CreationTimestamp: v1.NewTime(time.Date(2019, 10, 1, 12, n, 0, 0, time.UTC)),
+		},
+	}
+	build.Spec.Source.Git = &buildv1alpha1.Git{URL: "https://github.com/example/app", Revision: revision}
+	status := corev1.ConditionTrue
+	if ref == "" {
+		status = corev1.ConditionFalse
+	}
+	build.Status.LatestImage = ref
+	build.Status.Conditions = v1alpha1.Conditions{{Type: v1alpha1.ConditionSucceeded, Status: status}}
+	return build
+}
+
+func TestTrackedVersionMatchesCheck(t *testing.T) {
+	builds := []buildv1alpha1.Build{testBuild(1, "registry/app@sha256:1", "abc")}
+
+	for _, track := range []string{trackImage, trackSource} {
+		checked := versionsSince(builds, nil, &Config{Track: track})
+		require.Len(t, checked, 1)
+		require.Equal(t, checked[0], trackedVersion(&builds[0], track), track)
+	}
+	require.Equal(t, "2019-10-01T12:01:00Z", trackedVersion(&builds[0], trackImage)["created"])
+	require.Equal(t, "abc", trackedVersion(&builds[0], trackSource)["revision"])
+}
+
+func TestVersionsSinceReturnsHistory(t *testing.T) {
+	builds := []buildv1alpha1.Build{
+		testBuild(1, "registry/app@sha256:1", "a"),
+		testBuild(2, "registry/app@sha256:2", "b"),
+		testBuild(3, "", "c"),
+		testBuild(4, "registry/app@sha256:4", "d"),
+	}
+	config := &Config{Track: trackImage, TriggerOn: triggerOnRollback}
+
+	require.Equal(t, []oc.Version{buildVersion(&builds[1]), buildVersion(&builds[3])},
+		versionsSince(builds, buildVersion(&builds[0]), config))
+	require.Equal(t, []oc.Version{buildVersion(&builds[3])}, versionsSince(builds, nil, config))
+	require.Equal(t, []oc.Version{buildVersion(&builds[3])},
+		versionsSince(builds, oc.Version{"ref": "registry/app@sha256:pruned"}, config))
+	require.Empty(t, versionsSince(builds, buildVersion(&builds[3]), config))
+	require.Empty(t, versionsSince(builds[2:3], nil, config))
+}
+
+func TestCheckPagesThroughBuilds(t *testing.T) {
+	c := newFakeImageClient()
+	defer useFakeClient(c)()
+	var builds []buildv1alpha1.Build
+	for n := 1; n <= 5; n++ {
+		builds = append(builds, testBuild(n, "registry/app@sha256:"+strconv.Itoa(n), "abc"))
+	}
+	c.addBuilds(builds...)
+	c.addImage(testImage(builds...))
+
+	source := oc.Source{"image": "app", "namespace": "default", "page_size": 2}
+	versions, err := (&Resource{}).Check(source, buildVersion(&builds[0]), nil, oc.NewLogger(oc.SilentLevel))
+	require.NoError(t, err)
+	require.Len(t, versions, 4)
+
+	require.Len(t, c.listOptions, 3)
+	for i, options := range c.listOptions {
+		require.Equal(t, int64(2), options.Limit)
+		require.Equal(t, []string{"", "2", "4"}[i], options.Continue)
+	}
+}
+
+func TestVersionsSinceComparesDigests(t *testing.T) {
+	require.True(t, sameImage("registry/app:1@sha256:a", "registry/app:2@sha256:a"))
+	require.False(t, sameImage("registry/app@sha256:a", "registry/app@sha256:b"))
+	require.False(t, sameImage("registry/app:1", "registry/app:2"))
+
+	// The second build pushed the same image under another tag, so it is not new.
+	builds := []buildv1alpha1.Build{
+		testBuild(1, "registry/app:1@sha256:a", "abc"),
+		testBuild(2, "registry/app:2@sha256:a", "abc"),
+		testBuild(3, "registry/app:3@sha256:b", "abc"),
+	}
+	config := &Config{Track: trackImage, TriggerOn: triggerOnRollback}
+	require.Equal(t, []oc.Version{buildVersion(&builds[2])}, versionsSince(builds, buildVersion(&builds[0]), config))
+	require.Empty(t, versionsSince(builds[:2], buildVersion(&builds[0]), config))
+}
+
+func TestCancelBuild(t *testing.T) {
+	c := newFakeImageClient()
+	c.addBuilds(testBuild(1, "registry/app@sha256:1", "abc"), testBuild(2, "", "def"))
+
+	require.NoError(t, cancelBuild(c, "default", "app", 2))
+	require.Equal(t, []string{"app-build-2-abcde"}, c.deletedBuilds)
+	_, err := c.GetBuild("default", "app-build-1-abcde")
+	require.NoError(t, err)
+
+	// A build kpack has not created yet has nothing to delete.
+	require.NoError(t, cancelBuild(c, "default", "app", 3))
+	require.Len(t, c.deletedBuilds, 1)
+}
+
+func TestPreviousImage(t *testing.T) {
+	builds := []buildv1alpha1.Build{
+		testBuild(1, "registry/app@sha256:1", "a"),
+		testBuild(2, "", "b"),
+		testBuild(3, "registry/app@sha256:3", "c"),
+	}
+	require.Equal(t, "registry/app@sha256:1", previousImage(builds, builds[2].Name))
+	require.Empty(t, previousImage(builds, builds[0].Name))
+	require.Empty(t, previousImage(builds, "app-build-9-pruned"))
+	require.Equal(t, oc.Metadata{{Name: "previousImage", Value: "registry/app@sha256:1"}},
+		previousImageMetadata(previousImage(builds, builds[2].Name)))
+}
+
+func TestVersionsSinceTriggerOn(t *testing.T) {
+	// Image 1 is rebuilt identically, then replaced by 2, then rolled back to 1.
+	builds := []buildv1alpha1.Build{
+		testBuild(1, "registry/app@sha256:1", "a"),
+		testBuild(2, "registry/app@sha256:1", "a"),
+		testBuild(3, "registry/app@sha256:2", "b"),
+		testBuild(4, "registry/app@sha256:1", "a"),
+	}
+	old := buildVersion(&builds[0])
+
+	for triggerOn, want := range map[string][]oc.Version{
+		triggerOnRollback: {buildVersion(&builds[2]), buildVersion(&builds[3])},
+		triggerOnNew:      {buildVersion(&builds[2])},
+		triggerOnAny:      {buildVersion(&builds[1]), buildVersion(&builds[2]), buildVersion(&builds[3])},
+	} {
+		require.Equal(t, want, versionsSince(builds, old, &Config{Track: trackImage, TriggerOn: triggerOn}), triggerOn)
+	}
+}
+
+func TestMatchesReasons(t *testing.T) {
+	build := func(reason string) *buildv1alpha1.Build {
+		build := testBuild(1, "registry/app@sha256:1", "abc")
+		if reason != "" {
+			build.Annotations = map[string]string{buildv1alpha1.BuildReasonAnnotation: reason}
+		}
+		return &build
+	}
+
+	for _, test := range []struct {
+		reason          string
+		include, ignore []string
+		matches         bool
+	}{
+		{"COMMIT", nil, nil, true},
+		{"", nil, nil, true},
+		{"COMMIT", []string{"COMMIT"}, nil, true},
+		{"STACK", []string{"COMMIT"}, nil, false},
+		{"", []string{"COMMIT"}, nil, false},
+		{"CONFIG,COMMIT", []string{"COMMIT"}, nil, true},
+		{"STACK", nil, []string{"STACK"}, false},
+		{"COMMIT,STACK", nil, []string{"STACK"}, true},
+		{"stack, buildpack", nil, []string{"STACK", "BUILDPACK"}, false},
+		{"", nil, []string{"STACK"}, true},
+		{"COMMIT", []string{"COMMIT"}, []string{"COMMIT"}, false},
+	} {
+		require.Equal(t, test.matches, matchesReasons(build(test.reason), test.include, test.ignore), test)
+	}
+}
+
+func TestFilterBuildsByReason(t *testing.T) {
+	commit, stack := testBuild(1, "registry/app@sha256:1", "abc"), testBuild(2, "registry/app@sha256:2", "abc")
+	commit.Annotations = map[string]string{buildv1alpha1.BuildReasonAnnotation: "COMMIT"}
+	stack.Annotations = map[string]string{buildv1alpha1.BuildReasonAnnotation: "STACK"}
+	builds := []buildv1alpha1.Build{commit, stack}
+
+	config, err := parseSource(oc.Source{"image": "app", "ignore_build_reasons": []interface{}{"stack"}})
+	require.NoError(t, err)
+	require.Equal(t, []buildv1alpha1.Build{commit}, filterBuilds(builds, config))
+
+	config, err = parseSource(oc.Source{"image": "app", "build_reasons": []interface{}{"STACK"}})
+	require.NoError(t, err)
+	require.Equal(t, []buildv1alpha1.Build{stack}, filterBuilds(builds, config))
+
+	_, err = parseSource(oc.Source{"image": "app", "build_reasons": []interface{}{"PUSH"}})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `field "build_reasons" must only contain CONFIG, COMMIT, BUILDPACK, or STACK`)
+}
+
+func TestVersionsSinceNeverRepeatsOld(t *testing.T) {
+	builds := []buildv1alpha1.Build{
+		testBuild(1, "registry/app@sha256:1", "a"),
+		testBuild(2, "registry/app@sha256:2", "b"),
+		testBuild(3, "registry/app@sha256:1", "a"),
+	}
+
+	for _, track := range []string{trackImage, trackSource} {
+		for _, triggerOn := range []string{triggerOnNew, triggerOnRollback, triggerOnAny} {
+			config := &Config{Track: track, TriggerOn: triggerOn}
+			for i := range builds {
+				old := trackedVersion(&builds[i], track)
+				require.NotContains(t, versionsSince(builds, old, config), old, track, triggerOn, i)
+			}
+
+			// The latest build, by itself or with its value alone, has nothing after it.
+			latest := trackedVersion(&builds[2], track)
+			require.Empty(t, versionsSince(builds, latest, config), track, triggerOn)
+			key := trackedKey(track)
+			require.Empty(t, versionsSince(builds, oc.Version{key: latest[key]}, config), track, triggerOn)
+		}
+	}
+}
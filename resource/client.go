@@ -0,0 +1,141 @@
+package resource
+
+import (
+	buildv1alpha1 "github.com/pivotal/kpack/pkg/apis/build/v1alpha1"
+	"github.com/pivotal/kpack/pkg/client/clientset/versioned"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+// ImageClient is the part of the kpack API the resource depends on. Check, In, and Out only talk to
+// kpack through it, so tests can substitute a fake.
+type ImageClient interface {
+	GetImage(namespace, name string) (*buildv1alpha1.Image, error)
+	ListImages(namespace string, options v1.ListOptions) (*buildv1alpha1.ImageList, error)
+	WatchImages(namespace string, options v1.ListOptions) (watch.Interface, error)
+	CreateImage(image *buildv1alpha1.Image) (*buildv1alpha1.Image, error)
+	UpdateImage(image *buildv1alpha1.Image) (*buildv1alpha1.Image, error)
+	PatchImage(namespace, name string, patch []byte) (*buildv1alpha1.Image, error)
+
+	GetBuild(namespace, name string) (*buildv1alpha1.Build, error)
+	ListBuilds(namespace string, options v1.ListOptions) (*buildv1alpha1.BuildList, error)
+	CreateBuild(build *buildv1alpha1.Build) (*buildv1alpha1.Build, error)
+	PatchBuild(namespace, name string, patch []byte) (*buildv1alpha1.Build, error)
+	DeleteBuild(namespace, name string) error
+
+	GetBuilder(namespace, name string) (*buildv1alpha1.Builder, error)
+	GetClusterBuilder(name string) (*buildv1alpha1.ClusterBuilder, error)
+
+	GetSourceResolver(namespace, name string) (*buildv1alpha1.SourceResolver, error)
+}
+
+// kpackClient implements ImageClient with the generated kpack clientset. The generated clientset
+// cannot pass options to writes, so those go through its REST client to name fieldManager as the
+// manager of the fields they set.
+type kpackClient struct {
+	clientset    versioned.Interface
+	fieldManager string
+}
+
+// NewImageClient returns an ImageClient backed by clientset that records its writes as made by
+// fieldManager.
+func NewImageClient(clientset versioned.Interface, fieldManager string) ImageClient {
+	return &kpackClient{clientset: clientset, fieldManager: fieldManager}
+}
+
+func (c *kpackClient) GetImage(namespace, name string) (*buildv1alpha1.Image, error) {
+	return c.clientset.BuildV1alpha1().Images(namespace).Get(name, v1.GetOptions{})
+}
+
+func (c *kpackClient) ListImages(namespace string, options v1.ListOptions) (*buildv1alpha1.ImageList, error) {
+	return c.clientset.BuildV1alpha1().Images(namespace).List(options)
+}
+
+func (c *kpackClient) WatchImages(namespace string, options v1.ListOptions) (watch.Interface, error) {
+	return c.clientset.BuildV1alpha1().Images(namespace).Watch(options)
+}
+
+func (c *kpackClient) CreateImage(image *buildv1alpha1.Image) (*buildv1alpha1.Image, error) {
+	created := &buildv1alpha1.Image{}
+	return created, c.clientset.BuildV1alpha1().RESTClient().Post().
+		Namespace(image.Namespace).
+		Resource("images").
+		Param("fieldManager", c.fieldManager).
+		Body(image).
+		Do().
+		Into(created)
+}
+
+func (c *kpackClient) UpdateImage(image *buildv1alpha1.Image) (*buildv1alpha1.Image, error) {
+	updated := &buildv1alpha1.Image{}
+	return updated, c.clientset.BuildV1alpha1().RESTClient().Put().
+		Namespace(image.Namespace).
+		Resource("images").
+		Name(image.Name).
+		Param("fieldManager", c.fieldManager).
+		Body(image).
+		Do().
+		Into(updated)
+}
+
+// PatchImage applies a JSON merge patch to the named image.
+func (c *kpackClient) PatchImage(namespace, name string, patch []byte) (*buildv1alpha1.Image, error) {
+	patched := &buildv1alpha1.Image{}
+	return patched, c.clientset.BuildV1alpha1().RESTClient().Patch(types.MergePatchType).
+		Namespace(namespace).
+		Resource("images").
+		Name(name).
+		Param("fieldManager", c.fieldManager).
+		Body(patch).
+		Do().
+		Into(patched)
+}
+
+func (c *kpackClient) GetBuild(namespace, name string) (*buildv1alpha1.Build, error) {
+	return c.clientset.BuildV1alpha1().Builds(namespace).Get(name, v1.GetOptions{})
+}
+
+func (c *kpackClient) ListBuilds(namespace string, options v1.ListOptions) (*buildv1alpha1.BuildList, error) {
+	return c.clientset.BuildV1alpha1().Builds(namespace).List(options)
+}
+
+func (c *kpackClient) CreateBuild(build *buildv1alpha1.Build) (*buildv1alpha1.Build, error) {
+	created := &buildv1alpha1.Build{}
+	return created, c.clientset.BuildV1alpha1().RESTClient().Post().
+		Namespace(build.Namespace).
+		Resource("builds").
+		Param("fieldManager", c.fieldManager).
+		Body(build).
+		Do().
+		Into(created)
+}
+
+// PatchBuild applies a JSON merge patch to the named build.
+func (c *kpackClient) PatchBuild(namespace, name string, patch []byte) (*buildv1alpha1.Build, error) {
+	patched := &buildv1alpha1.Build{}
+	return patched, c.clientset.BuildV1alpha1().RESTClient().Patch(types.MergePatchType).
+		Namespace(namespace).
+		Resource("builds").
+		Name(name).
+		Param("fieldManager", c.fieldManager).
+		Body(patch).
+		Do().
+		Into(patched)
+}
+
+func (c *kpackClient) DeleteBuild(namespace, name string) error {
+	return c.clientset.BuildV1alpha1().Builds(namespace).Delete(name, &v1.DeleteOptions{})
+}
+
+func (c *kpackClient) GetBuilder(namespace, name string) (*buildv1alpha1.Builder, error) {
+	return c.clientset.BuildV1alpha1().Builders(namespace).Get(name, v1.GetOptions{})
+}
+
+func (c *kpackClient) GetClusterBuilder(name string) (*buildv1alpha1.ClusterBuilder, error) {
+	return c.clientset.BuildV1alpha1().ClusterBuilders().Get(name, v1.GetOptions{})
+}
+
+func (c *kpackClient) GetSourceResolver(namespace, name string) (*buildv1alpha1.SourceResolver, error) {
+	return c.clientset.BuildV1alpha1().SourceResolvers(namespace).Get(name, v1.GetOptions{})
+}
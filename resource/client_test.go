@@ -0,0 +1,522 @@
+package resource
+
+import (
+	"encoding/json"
+	oc "github.com/cloudboss/ofcourse/ofcourse"
+	buildv1alpha1 "github.com/pivotal/kpack/pkg/apis/build/v1alpha1"
+	"github.com/pivotal/kpack/pkg/client/clientset/versioned"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"knative.dev/pkg/apis/duck/v1alpha1"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeImageClient is an in-memory ImageClient. Writes are recorded so tests can check what was
+// sent, and onPatchImage and onCreateBuild stand in for the kpack controller reacting to a patched
+// image or a created build.
+type fakeImageClient struct {
+	mu sync.Mutex
+
+	images          map[string]*buildv1alpha1.Image
+	builds          map[string]*buildv1alpha1.Build
+	builders        map[string]*buildv1alpha1.Builder
+	clusterBuilders map[string]*buildv1alpha1.ClusterBuilder
+	sourceResolvers map[string]*buildv1alpha1.SourceResolver
+
+	// errs fails the named method, such as "ListBuilds", with its error.
+	errs map[string]error
+
+	imagePatches  [][]byte
+	buildPatches  map[string][]byte
+	deletedBuilds []string
+	listOptions   []v1.ListOptions
+
+	// watcher, when set, is the watch WatchImages returns.
+	watcher         *watch.FakeWatcher
+	onPatchImage    func(c *fakeImageClient, image *buildv1alpha1.Image)
+	onCreateBuild   func(c *fakeImageClient, build *buildv1alpha1.Build)
+	resourceVersion int
+}
+
+func newFakeImageClient() *fakeImageClient {
+	return &fakeImageClient{
+		images:          map[string]*buildv1alpha1.Image{},
+		builds:          map[string]*buildv1alpha1.Build{},
+		builders:        map[string]*buildv1alpha1.Builder{},
+		clusterBuilders: map[string]*buildv1alpha1.ClusterBuilder{},
+		sourceResolvers: map[string]*buildv1alpha1.SourceResolver{},
+		errs:            map[string]error{},
+		buildPatches:    map[string][]byte{},
+	}
+}
+
+// useFakeClient makes Check, In, and Out connect to c until the returned function is called.
+func useFakeClient(c *fakeImageClient) func() {
+	connect = func(*Logger, *Config, time.Duration) (ImageClient, *kubernetes.Clientset, error) {
+		return c, nil, nil
+	}
+	return func() { connect = getKubeconfig }
+}
+
+func objectKey(namespace, name string) string {
+	return namespace + "/" + name
+}
+
+func notFound(resource, name string) error {
+	return k8serrors.NewNotFound(schema.GroupResource{Group: buildv1alpha1.SchemeGroupVersion.Group, Resource: resource}, name)
+}
+
+// nextResourceVersion stamps an object as changed, as the API server does on every write.
+func (c *fakeImageClient) nextResourceVersion() string {
+	c.resourceVersion++
+	return strconv.Itoa(c.resourceVersion)
+}
+
+// addImage stores image, as though it had been created in the cluster.
+func (c *fakeImageClient) addImage(image *buildv1alpha1.Image) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	image = image.DeepCopy()
+	image.ResourceVersion = c.nextResourceVersion()
+	c.images[objectKey(image.Namespace, image.Name)] = image
+}
+
+// addBuilds stores builds, as though kpack had created them.
+func (c *fakeImageClient) addBuilds(builds ...buildv1alpha1.Build) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, build := range builds {
+		build := build.DeepCopy()
+		build.ResourceVersion = c.nextResourceVersion()
+		c.builds[objectKey(build.Namespace, build.Name)] = build
+	}
+}
+
+// testImage is image app in namespace default, built from a git repository by ClusterBuilder
+// default, as kpack leaves it after completing builds.
+func testImage(builds ...buildv1alpha1.Build) *buildv1alpha1.Image {
+	image := &buildv1alpha1.Image{
+		ObjectMeta: v1.ObjectMeta{Name: "app", Namespace: "default", Generation: 1},
+		Spec: buildv1alpha1.ImageSpec{
+			Tag:     "registry/app",
+			Builder: buildv1alpha1.ImageBuilder{TypeMeta: v1.TypeMeta{Kind: "ClusterBuilder"}, Name: "default"},
+			Source: buildv1alpha1.SourceConfig{
+				Git: &buildv1alpha1.Git{URL: "https://github.com/example/app", Revision: "main"},
+			},
+		},
+	}
+	for i := range builds {
+		setImageStatus(image, &builds[i])
+	}
+	return image
+}
+
+// setImageStatus records build as the latest build of image, as kpack does when it completes.
+func setImageStatus(image *buildv1alpha1.Image, build *buildv1alpha1.Build) {
+	image.Status.BuildCounter = buildNumber(build)
+	image.Status.LatestBuildRef = build.Name
+	status := corev1.ConditionFalse
+	if build.Status.GetCondition(v1alpha1.ConditionSucceeded).IsTrue() {
+		image.Status.LatestImage = build.Status.LatestImage
+		status = corev1.ConditionTrue
+	}
+	image.Status.Conditions = v1alpha1.Conditions{{Type: v1alpha1.ConditionReady, Status: status}}
+}
+
+// completeBuild stands in for kpack running build to completion for image app.
+func (c *fakeImageClient) completeBuild(build buildv1alpha1.Build) {
+	c.addBuilds(build)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	image := c.images[objectKey("default", "app")]
+	setImageStatus(image, &build)
+	image.ResourceVersion = c.nextResourceVersion()
+}
+
+// selects reports whether an object with the given name and labels matches the selectors in options.
+func selects(options v1.ListOptions, name string, objectLabels map[string]string) bool {
+	if options.LabelSelector != "" {
+		selector, err := labels.Parse(options.LabelSelector)
+		if err != nil || !selector.Matches(labels.Set(objectLabels)) {
+			return false
+		}
+	}
+	if options.FieldSelector != "" {
+		selector, err := fields.ParseSelector(options.FieldSelector)
+		if err != nil || !selector.Matches(fields.Set{"metadata.name": name}) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *fakeImageClient) GetImage(namespace, name string) (*buildv1alpha1.Image, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.errs["GetImage"]; err != nil {
+		return nil, err
+	}
+	image, ok := c.images[objectKey(namespace, name)]
+	if !ok {
+		return nil, notFound("images", name)
+	}
+	return image.DeepCopy(), nil
+}
+
+func (c *fakeImageClient) ListImages(namespace string, options v1.ListOptions) (*buildv1alpha1.ImageList, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.errs["ListImages"]; err != nil {
+		return nil, err
+	}
+	list := &buildv1alpha1.ImageList{}
+	for _, image := range c.images {
+		if (namespace == "" || image.Namespace == namespace) && selects(options, image.Name, image.Labels) {
+			list.Items = append(list.Items, *image.DeepCopy())
+		}
+	}
+	sort.Slice(list.Items, func(i, j int) bool {
+		return objectKey(list.Items[i].Namespace, list.Items[i].Name) < objectKey(list.Items[j].Namespace, list.Items[j].Name)
+	})
+	return list, nil
+}
+
+// WatchImages returns watcher or, without one, a watch that ends at once, so callers fall back to
+// polling.
+func (c *fakeImageClient) WatchImages(namespace string, options v1.ListOptions) (watch.Interface, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.errs["WatchImages"]; err != nil {
+		return nil, err
+	}
+	if c.watcher != nil {
+		return c.watcher, nil
+	}
+	return watch.NewEmptyWatch(), nil
+}
+
+func (c *fakeImageClient) CreateImage(image *buildv1alpha1.Image) (*buildv1alpha1.Image, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.errs["CreateImage"]; err != nil {
+		return nil, err
+	}
+	if _, ok := c.images[objectKey(image.Namespace, image.Name)]; ok {
+		return nil, k8serrors.NewAlreadyExists(schema.GroupResource{Resource: "images"}, image.Name)
+	}
+	created := image.DeepCopy()
+	created.ResourceVersion = c.nextResourceVersion()
+	c.images[objectKey(image.Namespace, image.Name)] = created
+	return created.DeepCopy(), nil
+}
+
+func (c *fakeImageClient) UpdateImage(image *buildv1alpha1.Image) (*buildv1alpha1.Image, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.errs["UpdateImage"]; err != nil {
+		return nil, err
+	}
+	if _, ok := c.images[objectKey(image.Namespace, image.Name)]; !ok {
+		return nil, notFound("images", image.Name)
+	}
+	updated := image.DeepCopy()
+	updated.ResourceVersion = c.nextResourceVersion()
+	c.images[objectKey(image.Namespace, image.Name)] = updated
+	return updated.DeepCopy(), nil
+}
+
+// PatchImage calls onPatchImage, when set, once the patch is stored.
+func (c *fakeImageClient) PatchImage(namespace, name string, patch []byte) (*buildv1alpha1.Image, error) {
+	patched, err := c.patchImage(namespace, name, patch)
+	if err == nil && c.onPatchImage != nil {
+		c.onPatchImage(c, patched.DeepCopy())
+	}
+	return patched, err
+}
+
+func (c *fakeImageClient) patchImage(namespace, name string, patch []byte) (*buildv1alpha1.Image, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.errs["PatchImage"]; err != nil {
+		return nil, err
+	}
+	image, ok := c.images[objectKey(namespace, name)]
+	if !ok {
+		return nil, notFound("images", name)
+	}
+	patched := &buildv1alpha1.Image{}
+	if err := mergePatch(image, patch, patched); err != nil {
+		return nil, err
+	}
+	patched.ResourceVersion = c.nextResourceVersion()
+	c.images[objectKey(namespace, name)] = patched
+	c.imagePatches = append(c.imagePatches, patch)
+	return patched.DeepCopy(), nil
+}
+
+func (c *fakeImageClient) GetBuild(namespace, name string) (*buildv1alpha1.Build, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.errs["GetBuild"]; err != nil {
+		return nil, err
+	}
+	build, ok := c.builds[objectKey(namespace, name)]
+	if !ok {
+		return nil, notFound("builds", name)
+	}
+	return build.DeepCopy(), nil
+}
+
+// ListBuilds pages through the matching builds options.Limit at a time, with the index of the next
+// build as the continue token.
+func (c *fakeImageClient) ListBuilds(namespace string, options v1.ListOptions) (*buildv1alpha1.BuildList, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.errs["ListBuilds"]; err != nil {
+		return nil, err
+	}
+	c.listOptions = append(c.listOptions, options)
+
+	var matched []buildv1alpha1.Build
+	for _, build := range c.builds {
+		if (namespace == "" || build.Namespace == namespace) && selects(options, build.Name, build.Labels) {
+			matched = append(matched, *build.DeepCopy())
+		}
+	}
+	sort.Slice(matched, func(i, j int) bool {
+		return objectKey(matched[i].Namespace, matched[i].Name) < objectKey(matched[j].Namespace, matched[j].Name)
+	})
+
+	start, _ := strconv.Atoi(options.Continue)
+	end := len(matched)
+	list := &buildv1alpha1.BuildList{}
+	if options.Limit > 0 && start+int(options.Limit) < end {
+		end = start + int(options.Limit)
+		list.Continue = strconv.Itoa(end)
+	}
+	list.Items = matched[start:end]
+	return list, nil
+}
+
+func (c *fakeImageClient) CreateBuild(build *buildv1alpha1.Build) (*buildv1alpha1.Build, error) {
+	created, err := c.createBuild(build)
+	if err == nil && c.onCreateBuild != nil {
+		c.onCreateBuild(c, created.DeepCopy())
+	}
+	return created, err
+}
+
+func (c *fakeImageClient) createBuild(build *buildv1alpha1.Build) (*buildv1alpha1.Build, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.errs["CreateBuild"]; err != nil {
+		return nil, err
+	}
+	created := build.DeepCopy()
+	if created.Name == "" {
+		created.Name = created.GenerateName + strconv.Itoa(len(c.builds))
+	}
+	created.CreationTimestamp = v1.Now()
+	created.ResourceVersion = c.nextResourceVersion()
+	c.builds[objectKey(created.Namespace, created.Name)] = created
+	return created.DeepCopy(), nil
+}
+
+func (c *fakeImageClient) PatchBuild(namespace, name string, patch []byte) (*buildv1alpha1.Build, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.errs["PatchBuild"]; err != nil {
+		return nil, err
+	}
+	build, ok := c.builds[objectKey(namespace, name)]
+	if !ok {
+		return nil, notFound("builds", name)
+	}
+	patched := &buildv1alpha1.Build{}
+	if err := mergePatch(build, patch, patched); err != nil {
+		return nil, err
+	}
+	patched.ResourceVersion = c.nextResourceVersion()
+	c.builds[objectKey(namespace, name)] = patched
+	c.buildPatches[name] = patch
+	return patched.DeepCopy(), nil
+}
+
+func (c *fakeImageClient) DeleteBuild(namespace, name string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.errs["DeleteBuild"]; err != nil {
+		return err
+	}
+	if _, ok := c.builds[objectKey(namespace, name)]; !ok {
+		return notFound("builds", name)
+	}
+	delete(c.builds, objectKey(namespace, name))
+	c.deletedBuilds = append(c.deletedBuilds, name)
+	return nil
+}
+
+func (c *fakeImageClient) GetBuilder(namespace, name string) (*buildv1alpha1.Builder, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.errs["GetBuilder"]; err != nil {
+		return nil, err
+	}
+	builder, ok := c.builders[objectKey(namespace, name)]
+	if !ok {
+		return nil, notFound("builders", name)
+	}
+	return builder.DeepCopy(), nil
+}
+
+func (c *fakeImageClient) GetClusterBuilder(name string) (*buildv1alpha1.ClusterBuilder, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.errs["GetClusterBuilder"]; err != nil {
+		return nil, err
+	}
+	builder, ok := c.clusterBuilders[name]
+	if !ok {
+		return nil, notFound("clusterbuilders", name)
+	}
+	return builder.DeepCopy(), nil
+}
+
+func (c *fakeImageClient) GetSourceResolver(namespace, name string) (*buildv1alpha1.SourceResolver, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.errs["GetSourceResolver"]; err != nil {
+		return nil, err
+	}
+	resolver, ok := c.sourceResolvers[objectKey(namespace, name)]
+	if !ok {
+		return nil, notFound("sourceresolvers", name)
+	}
+	return resolver.DeepCopy(), nil
+}
+
+// mergePatch applies a JSON merge patch to original and decodes the result into patched.
+func mergePatch(original interface{}, patch []byte, patched interface{}) error {
+	originalJSON, err := json.Marshal(original)
+	if err != nil {
+		return err
+	}
+	var document, changes interface{}
+	if err := json.Unmarshal(originalJSON, &document); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(patch, &changes); err != nil {
+		return err
+	}
+	merged, err := json.Marshal(mergeJSON(document, changes))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(merged, patched)
+}
+
+// mergeJSON merges patch into document as RFC 7386 describes: objects merge key by key, a null
+// removes a key, and anything else replaces what was there.
+func mergeJSON(document, patch interface{}) interface{} {
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	documentObject, ok := document.(map[string]interface{})
+	if !ok {
+		documentObject = map[string]interface{}{}
+	}
+	for k, v := range patchObject {
+		if v == nil {
+			delete(documentObject, k)
+			continue
+		}
+		documentObject[k] = mergeJSON(documentObject[k], v)
+	}
+	return documentObject
+}
+
+func TestFakeImageClientPagesBuilds(t *testing.T) {
+	c := newFakeImageClient()
+	for n := 1; n <= 5; n++ {
+		c.addBuilds(testBuild(n, "registry/app@sha256:"+strconv.Itoa(n), "abc"))
+	}
+
+	builds, err := listBuilds(c, "default", "app", 2)
+	require.NoError(t, err)
+	require.Len(t, builds, 5)
+	require.Len(t, c.listOptions, 3)
+	for i := range builds {
+		require.Equal(t, int64(i+1), buildNumber(&builds[i]))
+	}
+}
+
+func TestCheckAgainstFakeClient(t *testing.T) {
+	c := newFakeImageClient()
+	defer useFakeClient(c)()
+	builds := []buildv1alpha1.Build{
+		testBuild(1, "registry/app@sha256:1", "abc"),
+		testBuild(2, "", "def"),
+		testBuild(3, "registry/app@sha256:3", "ghi"),
+	}
+	c.addBuilds(builds...)
+	c.addImage(testImage(builds...))
+
+	r := &Resource{}
+	source := oc.Source{"image": "app", "namespace": "default"}
+	logger := oc.NewLogger(oc.SilentLevel)
+
+	versions, err := r.Check(source, nil, nil, logger)
+	require.NoError(t, err)
+	require.Equal(t, []oc.Version{buildVersion(&builds[2])}, versions)
+
+	versions, err = r.Check(source, buildVersion(&builds[0]), nil, logger)
+	require.NoError(t, err)
+	require.Equal(t, []oc.Version{buildVersion(&builds[2])}, versions)
+
+	versions, err = r.Check(source, buildVersion(&builds[2]), nil, logger)
+	require.NoError(t, err)
+	require.Empty(t, versions)
+
+	_, err = r.Check(oc.Source{"image": "missing", "namespace": "default"}, nil, nil, logger)
+	require.EqualError(t, err, "image missing not found in namespace default")
+}
+
+func TestImageClientFieldManager(t *testing.T) {
+	var fieldManagers []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fieldManagers = append(fieldManagers, r.URL.Query().Get("fieldManager"))
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"apiVersion": "build.pivotal.io/v1alpha1", "kind": "Image", "metadata": {"name": "app"}}`))
+	}))
+	defer server.Close()
+
+	clientset, err := versioned.NewForConfig(&rest.Config{Host: server.URL})
+	require.NoError(t, err)
+	client := NewImageClient(clientset, "ci-pipeline")
+
+	_, err = client.PatchImage("default", "app", []byte(`{}`))
+	require.NoError(t, err)
+	_, err = client.UpdateImage(testImage())
+	require.NoError(t, err)
+	require.Equal(t, []string{"ci-pipeline", "ci-pipeline"}, fieldManagers)
+
+	config, err := parseSource(oc.Source{"image": "app"})
+	require.NoError(t, err)
+	require.Equal(t, defaultFieldManager, config.FieldManager)
+}
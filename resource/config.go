@@ -0,0 +1,971 @@
+package resource
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	oc "github.com/cloudboss/ofcourse/ofcourse"
+	buildv1alpha1 "github.com/pivotal/kpack/pkg/apis/build/v1alpha1"
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"math"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultMinPollInterval and defaultPollInterval bound how long Out waits between checks of the
+	// image status. The wait starts at the minimum and doubles up to the maximum while nothing
+	// changes.
+	defaultMinPollInterval = time.Second
+	defaultPollInterval    = 15 * time.Second
+	// defaultBuildTimeout is how long Out waits for a triggered build before giving up.
+	defaultBuildTimeout = 30 * time.Minute
+	// defaultCheckTimeout bounds each API request Check makes, and how long it may watch for a new
+	// image.
+	defaultCheckTimeout = time.Minute
+	// defaultAPIVersion is the only kpack API version the vendored kpack provides, and the version
+	// of a fork's API when api_version is unset.
+	defaultAPIVersion = "v1alpha1"
+	// defaultAPIQPS and defaultAPIBurst match client-go's own client-side rate limits, which keep
+	// many pipelines checking at once from overwhelming the API server.
+	defaultAPIQPS   = 5
+	defaultAPIBurst = 10
+	// defaultAPIRetries and defaultAPIRetryBackoff control how transient API errors are retried.
+	// The backoff doubles after every attempt.
+	defaultAPIRetries      = 4
+	defaultAPIRetryBackoff = 500 * time.Millisecond
+	// trackImage, trackSource, and trackSourceResolver are the values of the `track` source field.
+	trackImage          = "image"
+	trackSource         = "source"
+	trackSourceResolver = "sourceresolver"
+	// triggerOnNew, triggerOnRollback, and triggerOnAny are the values of the `trigger_on` source
+	// field. See versionsSince.
+	triggerOnNew      = "new"
+	triggerOnRollback = "rollback"
+	triggerOnAny      = "any"
+	// logLevelDebug, logLevelInfo, logLevelWarn, logLevelError, and logLevelSilent are the values of
+	// the `log_level` source field, which ofcourse also reads to set the level of its logger.
+	// logLevelQuiet is accepted as well and, like the levels above info, stops build logs being
+	// streamed; ofcourse logs at info for it.
+	logLevelDebug  = oc.DebugLevel
+	logLevelInfo   = oc.InfoLevel
+	logLevelWarn   = oc.WarnLevel
+	logLevelError  = oc.ErrorLevel
+	logLevelSilent = oc.SilentLevel
+	logLevelQuiet  = "quiet"
+	// logFormatText and logFormatJSON are the values of the `log_format` source field.
+	logFormatText = "text"
+	logFormatJSON = "json"
+	// outModeImage and outModeBuild are the values of the `out_mode` put param.
+	outModeImage = "image"
+	outModeBuild = "build"
+	// waitStart and waitFinish are the values of the `wait` put param.
+	waitStart  = "start"
+	waitFinish = "finish"
+	// defaultReadyCondition is the image condition kpack sets once the latest build succeeded.
+	defaultReadyCondition = "Ready"
+	// defaultFieldManager is the field manager the resource's writes are recorded under.
+	defaultFieldManager = "kpack-resource"
+	// defaultPageSize is how many builds are requested at a time when listing an image's history.
+	defaultPageSize = 100
+)
+
+// conditionTypePattern matches the condition types Kubernetes resources report, such as Ready or
+// example.com/Healthy.
+var conditionTypePattern = regexp.MustCompile(`^[A-Za-z]([A-Za-z0-9./-]*[A-Za-z0-9])?$`)
+
+// Config is the validated form of the resource's `source` configuration.
+type Config struct {
+	// Kubeconfig is an inline kubeconfig and KubeconfigPath the path to a kubeconfig file, such as a
+	// mounted secret. At most one may be set; the `kubeconfig_base64` source field sets Kubeconfig
+	// from a base64 encoded kubeconfig. When neither is, or when InCluster is set, the
+	// in-cluster service account is used.
+	Kubeconfig     string
+	KubeconfigPath string
+	InCluster      bool
+	// Context selects a context of the kubeconfig other than its current one.
+	Context string
+	// ImpersonateUser and ImpersonateGroups make every request act as another identity, such as a
+	// least-privilege service account, instead of the configured credentials.
+	ImpersonateUser   string
+	ImpersonateGroups []string
+	// SkipPrecheck skips checking that the API server is reachable before using it.
+	SkipPrecheck bool
+	// APIServer and Token authenticate with a bearer token instead of a kubeconfig, trusting the
+	// PEM encoded CACert when it is set.
+	APIServer string
+	Token     string
+	CACert    string
+	// InsecureSkipTLSVerify disables verification of the API server's certificate. It is meant for
+	// development clusters with self-signed certificates only.
+	InsecureSkipTLSVerify bool
+	// APIGroup is kpack's API group by default; a fork serving the same resources under another
+	// group is read with the dynamic client at APIVersion. kpack itself is always read at
+	// defaultAPIVersion.
+	APIVersion string
+	APIGroup   string
+
+	// Namespace holds the image. When it is unset it comes from the kubeconfig context, falling back
+	// to "default". AllNamespaces instead makes Check and In search every namespace; Out cannot.
+	Namespace     string
+	AllNamespaces bool
+	// BuildNamespace holds the builds of the image when a custom kpack setup creates them outside
+	// the image's namespace. See buildNamespace.
+	BuildNamespace string
+	// Image names the tracked image. LabelSelector is an alternative that must match exactly one,
+	// and Images lists several images whose builds Check reports as one stream of versions.
+	Image         string
+	LabelSelector string
+	Images        []string
+
+	// RequireImage makes Check fail when the image does not exist. Otherwise a missing image is
+	// reported as a warning with no versions. Defaults to true.
+	RequireImage bool
+	// Track selects whether Check reports a version for every new image or for every new git
+	// revision kpack built, or, with trackSourceResolver, for every revision kpack resolves the
+	// image's source to, before it is built. Defaults to trackImage.
+	Track string
+	// TriggerOn selects which builds Check reports: only ones with a never-seen image or revision,
+	// also ones reverting to an earlier one, or every build. Defaults to triggerOnRollback.
+	TriggerOn string
+	// IgnoreOwnTriggers makes Check skip builds a put triggered, so that a pipeline that both puts
+	// and checks an image does not trigger itself again.
+	IgnoreOwnTriggers bool
+	// ReadyCondition is the image condition type Check and Out treat as readiness, for controllers
+	// that report it under another name. Defaults to defaultReadyCondition.
+	ReadyCondition string
+	// SourceSubPath limits Check to builds of this subdirectory of the source, for monorepos with an
+	// image per service. All builds are considered when it is empty.
+	SourceSubPath string
+	// BuildReasons limits Check to builds kpack started for at least one of these reasons, such as
+	// COMMIT or CONFIG. IgnoreBuildReasons skips builds kpack only started for these reasons, such
+	// as STACK and BUILDPACK for rebuilds caused by builder updates.
+	BuildReasons       []string
+	IgnoreBuildReasons []string
+	// MetadataKeys renames the metadata entries In and Out return, from their default names to the
+	// names given. Entries that are not listed keep their default names.
+	MetadataKeys map[string]string
+	// Debug makes Check log the full status of the images it looks at.
+	Debug bool
+	// LogLevel controls how much Out prints. Build logs are only streamed at logLevelInfo and
+	// logLevelDebug. Defaults to logLevelInfo.
+	LogLevel string
+	// LogFormat selects whether the resource's own logs are written as text or JSON. Build logs are
+	// always text. Defaults to logFormatText.
+	LogFormat string
+	// Watch makes Check block for up to CheckTimeout waiting for a new image. CheckTimeout also
+	// bounds every API request Check makes.
+	Watch        bool
+	CheckTimeout time.Duration
+	// MinPollInterval, PollInterval, and BuildTimeout control how Out waits for a triggered build.
+	// Out polls every MinPollInterval at first and backs off to PollInterval; see pollBackoff.
+	MinPollInterval time.Duration
+	PollInterval    time.Duration
+	BuildTimeout    time.Duration
+	// ScheduleTimeout is how long Out lets the scheduler fail to place a build's pod before failing
+	// with the scheduler's reason. Out does not watch for unschedulable pods when it is unset.
+	ScheduleTimeout time.Duration
+
+	// APIQPS and APIBurst rate limit requests to the Kubernetes API.
+	APIQPS   float32
+	APIBurst int
+	// UserAgent identifies the resource in the API server's audit logs and metrics. Defaults to
+	// kpack-resource/<Version>.
+	UserAgent string
+	// FieldManager is recorded as the manager of the fields the resource sets on images and builds.
+	// Defaults to defaultFieldManager.
+	FieldManager string
+	// TriggerAnnotation is an image annotation Out sets to ask for a rebuild, for kpack versions or
+	// controllers that rebuild when it changes. When it is unset Out sets triggerEnvVar instead, the
+	// only trigger the pinned kpack acts on.
+	TriggerAnnotation string
+	// APIRetries is how many times a transiently failing API request is retried, starting
+	// APIRetryBackoff after the first failure.
+	APIRetries      int
+	APIRetryBackoff time.Duration
+
+	// PageSize limits how many builds each list request returns.
+	PageSize int64
+
+	// HTTPSProxy and NoProxy override the HTTPS_PROXY and NO_PROXY environment variables for
+	// connections to the API server.
+	HTTPSProxy string
+	NoProxy    string
+	// RegistryUsername and RegistryPassword authenticate registry access. They must never be logged.
+	RegistryUsername string
+	RegistryPassword string
+	// RegistryCACert is a PEM encoded CA trusted for registry access in addition to the system's.
+	RegistryCACert string
+}
+
+// parseSource validates the source configuration shared by Check, In, and Out.
+func parseSource(source oc.Source) (*Config, error) {
+	var (
+		config = &Config{}
+		err    error
+	)
+
+	if config.Kubeconfig, err = getString(source, "kubeconfig"); err != nil {
+		return nil, ErrMissingKubeconfig
+	}
+	if config.KubeconfigPath, err = getString(source, "kubeconfig_path"); err != nil {
+		return nil, errors.WithMessage(err, "invalid source")
+	}
+	if config.Kubeconfig != "" && config.KubeconfigPath != "" {
+		return nil, errors.New(`source fields "kubeconfig" and "kubeconfig_path" are mutually exclusive`)
+	}
+	encodedKubeconfig, err := getString(source, "kubeconfig_base64")
+	if err != nil {
+		return nil, errors.WithMessage(err, "invalid source")
+	}
+	if encodedKubeconfig != "" {
+		if config.Kubeconfig != "" || config.KubeconfigPath != "" {
+			return nil, errors.New(`source field "kubeconfig_base64" cannot be combined with "kubeconfig" or "kubeconfig_path"`)
+		}
+		if config.Kubeconfig, err = decodeBase64(encodedKubeconfig); err != nil {
+			return nil, errors.Wrap(err, `invalid source: field "kubeconfig_base64" is not valid base64`)
+		}
+		if strings.TrimSpace(config.Kubeconfig) == "" {
+			return nil, errors.New(`source field "kubeconfig_base64" must not decode to an empty kubeconfig`)
+		}
+	}
+	if config.APIServer, err = getString(source, "api_server"); err != nil {
+		return nil, errors.WithMessage(err, "invalid source")
+	}
+	if config.Token, err = getString(source, "token"); err != nil {
+		return nil, errors.WithMessage(err, "invalid source")
+	}
+	if config.CACert, err = getString(source, "ca_cert"); err != nil {
+		return nil, errors.WithMessage(err, "invalid source")
+	}
+	if (config.APIServer == "") != (config.Token == "") {
+		return nil, errors.New(`source fields "api_server" and "token" must be set together`)
+	}
+	if config.APIServer != "" && (config.Kubeconfig != "" || config.KubeconfigPath != "") {
+		return nil, errors.New(`source field "api_server" cannot be combined with a kubeconfig`)
+	}
+	if config.CACert != "" && !x509.NewCertPool().AppendCertsFromPEM([]byte(config.CACert)) {
+		return nil, errors.New(`source field "ca_cert" must contain a PEM encoded certificate`)
+	}
+
+	if config.InCluster, err = getBool(source, "in_cluster"); err != nil {
+		return nil, errors.WithMessage(err, "invalid source")
+	}
+	if config.InCluster && (config.APIServer != "" || config.Kubeconfig != "" || config.KubeconfigPath != "") {
+		return nil, errors.New(`source field "in_cluster" cannot be combined with "api_server" or a kubeconfig`)
+	}
+	if config.ImpersonateUser, err = getString(source, "impersonate_user"); err != nil {
+		return nil, errors.WithMessage(err, "invalid source")
+	}
+	if config.ImpersonateGroups, err = getStringList(source, "impersonate_groups"); err != nil {
+		return nil, errors.WithMessage(err, "invalid source")
+	}
+	if len(config.ImpersonateGroups) > 0 && config.ImpersonateUser == "" {
+		return nil, errors.New(`source field "impersonate_groups" requires "impersonate_user"`)
+	}
+
+	if config.SkipPrecheck, err = getBool(source, "skip_precheck"); err != nil {
+		return nil, errors.WithMessage(err, "invalid source")
+	}
+	if config.Context, err = getString(source, "context"); err != nil {
+		return nil, errors.WithMessage(err, "invalid source")
+	}
+	if config.Context != "" && config.Kubeconfig == "" && config.KubeconfigPath == "" {
+		return nil, errors.New(`source field "context" requires "kubeconfig" or "kubeconfig_path"`)
+	}
+	if config.InsecureSkipTLSVerify, err = getBool(source, "insecure_skip_tls_verify"); err != nil {
+		return nil, errors.WithMessage(err, "invalid source")
+	}
+	if config.InsecureSkipTLSVerify && config.CACert != "" {
+		return nil, errors.New(`source fields "insecure_skip_tls_verify" and "ca_cert" are mutually exclusive`)
+	}
+
+	if config.APIGroup, err = getString(source, "api_group"); err != nil {
+		return nil, errors.WithMessage(err, "invalid source")
+	}
+	if config.APIVersion, err = getString(source, "api_version"); err != nil {
+		return nil, errors.WithMessage(err, "invalid source")
+	}
+	// The vendored kpack only ships the v1alpha1 API, so kpack itself is always read at that version.
+	// api_version only names the version a fork serves under its own api_group.
+	if config.APIVersion != "" && (config.APIGroup == "" || config.APIGroup == buildv1alpha1.SchemeGroupVersion.Group) {
+		return nil, errors.Errorf(`source field "api_version" requires "api_group": kpack itself is only supported at %s`,
+			defaultAPIVersion)
+	}
+	if config.APIGroup == "" {
+		config.APIGroup = buildv1alpha1.SchemeGroupVersion.Group
+	}
+	if config.APIVersion == "" {
+		config.APIVersion = defaultAPIVersion
+	}
+
+	if config.Namespace, err = getString(source, "namespace"); err != nil {
+		return nil, ErrMissingNamespace
+	}
+	if config.AllNamespaces, err = getBool(source, "all_namespaces"); err != nil {
+		return nil, errors.WithMessage(err, "invalid source")
+	}
+	if config.AllNamespaces && config.Namespace != "" {
+		return nil, errors.New(`source fields "namespace" and "all_namespaces" are mutually exclusive`)
+	}
+	if config.BuildNamespace, err = getString(source, "build_namespace"); err != nil {
+		return nil, errors.WithMessage(err, "invalid source")
+	}
+
+	if config.Image, err = getString(source, "image"); err != nil {
+		return nil, ErrMissingImage
+	}
+	if config.LabelSelector, err = getString(source, "label_selector"); err != nil {
+		return nil, errors.WithMessage(err, "invalid source")
+	}
+	if config.Images, err = getStringList(source, "images"); err != nil {
+		return nil, errors.WithMessage(err, "invalid source")
+	}
+	if _, ok := source["images"]; ok && len(config.Images) == 0 {
+		return nil, errors.New(`source field "images" must not be empty`)
+	}
+	set := 0
+	for _, selected := range []bool{config.Image != "", config.LabelSelector != "", config.Images != nil} {
+		if selected {
+			set++
+		}
+	}
+	switch {
+	case set > 1:
+		return nil, errors.New(`source fields "image", "label_selector", and "images" are mutually exclusive`)
+	case set == 0:
+		return nil, ErrMissingImage
+	}
+
+	if config.RequireImage, err = getBoolDefault(source, "require_image", true); err != nil {
+		return nil, errors.WithMessage(err, "invalid source")
+	}
+
+	if config.Track, err = getString(source, "track"); err != nil {
+		return nil, errors.WithMessage(err, "invalid source")
+	}
+	switch config.Track {
+	case "":
+		config.Track = trackImage
+	case trackImage, trackSource, trackSourceResolver:
+	default:
+		return nil, errors.Errorf(`source field "track" must be "%s", "%s", or "%s"`,
+			trackImage, trackSource, trackSourceResolver)
+	}
+	if config.Track == trackSourceResolver && config.Images != nil {
+		return nil, errors.Errorf(`source field "track: %s" cannot be combined with "images"`, trackSourceResolver)
+	}
+
+	if config.TriggerOn, err = getString(source, "trigger_on"); err != nil {
+		return nil, errors.WithMessage(err, "invalid source")
+	}
+	switch config.TriggerOn {
+	case "":
+		config.TriggerOn = triggerOnRollback
+	case triggerOnNew, triggerOnRollback, triggerOnAny:
+	default:
+		return nil, errors.Errorf(`source field "trigger_on" must be "%s", "%s", or "%s"`,
+			triggerOnNew, triggerOnRollback, triggerOnAny)
+	}
+
+	if config.BuildReasons, err = getBuildReasons(source, "build_reasons"); err != nil {
+		return nil, errors.WithMessage(err, "invalid source")
+	}
+	if config.IgnoreBuildReasons, err = getBuildReasons(source, "ignore_build_reasons"); err != nil {
+		return nil, errors.WithMessage(err, "invalid source")
+	}
+
+	if config.MetadataKeys, err = getStringMap(source, "metadata_keys"); err != nil {
+		return nil, errors.WithMessage(err, "invalid source")
+	}
+	for from, to := range config.MetadataKeys {
+		if to == "" {
+			return nil, errors.Errorf(`source field "metadata_keys.%s" must not be empty`, from)
+		}
+	}
+
+	if config.IgnoreOwnTriggers, err = getBool(source, "ignore_own_triggers"); err != nil {
+		return nil, errors.WithMessage(err, "invalid source")
+	}
+
+	if config.ReadyCondition, err = getString(source, "ready_condition"); err != nil {
+		return nil, errors.WithMessage(err, "invalid source")
+	}
+	if config.ReadyCondition == "" {
+		config.ReadyCondition = defaultReadyCondition
+	}
+	if !conditionTypePattern.MatchString(config.ReadyCondition) {
+		return nil, errors.Errorf(`source field "ready_condition" must be a condition type such as "%s"`, defaultReadyCondition)
+	}
+
+	if config.SourceSubPath, err = getString(source, "source_subpath"); err != nil {
+		return nil, errors.WithMessage(err, "invalid source")
+	}
+
+	if config.Debug, err = getBool(source, "debug"); err != nil {
+		return nil, errors.WithMessage(err, "invalid source")
+	}
+
+	if config.LogLevel, err = getString(source, "log_level"); err != nil {
+		return nil, errors.WithMessage(err, "invalid source")
+	}
+	switch config.LogLevel {
+	case "":
+		config.LogLevel = logLevelInfo
+	case logLevelDebug, logLevelInfo, logLevelWarn, logLevelError, logLevelSilent, logLevelQuiet:
+	default:
+		return nil, errors.Errorf(`source field "log_level" must be "%s", "%s", "%s", "%s", "%s", or "%s"`,
+			logLevelDebug, logLevelInfo, logLevelWarn, logLevelError, logLevelSilent, logLevelQuiet)
+	}
+
+	if config.LogFormat, err = getString(source, "log_format"); err != nil {
+		return nil, errors.WithMessage(err, "invalid source")
+	}
+	switch config.LogFormat {
+	case "":
+		config.LogFormat = logFormatText
+	case logFormatText, logFormatJSON:
+	default:
+		return nil, errors.Errorf(`source field "log_format" must be "%s" or "%s"`, logFormatText, logFormatJSON)
+	}
+
+	if config.Watch, err = getBool(source, "watch"); err != nil {
+		return nil, errors.WithMessage(err, "invalid source")
+	}
+	if config.Watch && config.Images != nil {
+		return nil, errors.New(`source field "watch" cannot be combined with "images"`)
+	}
+	if config.CheckTimeout, err = getDuration(source, "check_timeout", defaultCheckTimeout); err != nil {
+		return nil, errors.WithMessage(err, "invalid source")
+	}
+	if config.PollInterval, err = getDuration(source, "poll_interval", defaultPollInterval); err != nil {
+		return nil, errors.WithMessage(err, "invalid source")
+	}
+	minPollInterval := defaultMinPollInterval
+	if config.PollInterval < minPollInterval {
+		minPollInterval = config.PollInterval
+	}
+	if config.MinPollInterval, err = getDuration(source, "min_poll_interval", minPollInterval); err != nil {
+		return nil, errors.WithMessage(err, "invalid source")
+	}
+	if config.MinPollInterval > config.PollInterval {
+		return nil, errors.New(`source field "min_poll_interval" must not be greater than "poll_interval"`)
+	}
+	if config.BuildTimeout, err = getDuration(source, "build_timeout", defaultBuildTimeout); err != nil {
+		return nil, errors.WithMessage(err, "invalid source")
+	}
+	if config.ScheduleTimeout, err = getDuration(source, "schedule_timeout", 0); err != nil {
+		return nil, errors.WithMessage(err, "invalid source")
+	}
+
+	qps, err := getPositiveNumber(source, "api_qps", defaultAPIQPS)
+	if err != nil {
+		return nil, errors.WithMessage(err, "invalid source")
+	}
+	config.APIQPS = float32(qps)
+
+	burst, err := getPositiveNumber(source, "api_burst", defaultAPIBurst)
+	if err != nil {
+		return nil, errors.WithMessage(err, "invalid source")
+	}
+	config.APIBurst = int(burst)
+
+	if config.UserAgent, err = getString(source, "user_agent"); err != nil {
+		return nil, errors.WithMessage(err, "invalid source")
+	}
+	if config.UserAgent == "" {
+		config.UserAgent = "kpack-resource/" + Version
+	}
+	if config.FieldManager, err = getString(source, "field_manager"); err != nil {
+		return nil, errors.WithMessage(err, "invalid source")
+	}
+	if config.FieldManager == "" {
+		config.FieldManager = defaultFieldManager
+	}
+	if config.TriggerAnnotation, err = getString(source, "trigger_annotation"); err != nil {
+		return nil, errors.WithMessage(err, "invalid source")
+	}
+	if config.TriggerAnnotation != "" {
+		if msgs := validation.IsQualifiedName(config.TriggerAnnotation); len(msgs) > 0 {
+			return nil, errors.Errorf(`source field "trigger_annotation" is not a valid annotation key: %s`, strings.Join(msgs, "; "))
+		}
+	}
+
+	retries, err := getNonNegativeInt(source, "api_retries", defaultAPIRetries)
+	if err != nil {
+		return nil, errors.WithMessage(err, "invalid source")
+	}
+	config.APIRetries = retries
+
+	if config.APIRetryBackoff, err = getDuration(source, "api_retry_backoff", defaultAPIRetryBackoff); err != nil {
+		return nil, errors.WithMessage(err, "invalid source")
+	}
+
+	if config.HTTPSProxy, err = getString(source, "https_proxy"); err != nil {
+		return nil, errors.WithMessage(err, "invalid source")
+	}
+	if config.HTTPSProxy != "" {
+		if _, err := url.Parse(config.HTTPSProxy); err != nil {
+			return nil, errors.Wrap(err, `source field "https_proxy" must be a URL`)
+		}
+	}
+	if config.NoProxy, err = getString(source, "no_proxy"); err != nil {
+		return nil, errors.WithMessage(err, "invalid source")
+	}
+
+	pageSize, err := getPositiveNumber(source, "page_size", defaultPageSize)
+	if err != nil {
+		return nil, errors.WithMessage(err, "invalid source")
+	}
+	config.PageSize = int64(pageSize)
+
+	if config.RegistryUsername, err = getString(source, "registry_username"); err != nil {
+		return nil, errors.WithMessage(err, "invalid source")
+	}
+	if config.RegistryPassword, err = getString(source, "registry_password"); err != nil {
+		return nil, errors.WithMessage(err, "invalid source")
+	}
+	if (config.RegistryUsername == "") != (config.RegistryPassword == "") {
+		return nil, errors.New(`source fields "registry_username" and "registry_password" must be set together`)
+	}
+	if config.RegistryCACert, err = getString(source, "registry_ca_cert"); err != nil {
+		return nil, errors.WithMessage(err, "invalid source")
+	}
+	if config.RegistryCACert != "" && !x509.NewCertPool().AppendCertsFromPEM([]byte(config.RegistryCACert)) {
+		return nil, errors.New(`source field "registry_ca_cert" must contain a PEM encoded certificate`)
+	}
+
+	return config, nil
+}
+
+// buildNamespace is the namespace holding the builds of an image in imageNamespace.
+func (c *Config) buildNamespace(imageNamespace string) string {
+	if c.BuildNamespace != "" {
+		return c.BuildNamespace
+	}
+	return imageNamespace
+}
+
+// getString reads an optional string from a source or params map.
+func getString(values map[string]interface{}, key string) (string, error) {
+	raw, ok := values[key]
+	if !ok || raw == nil {
+		return "", nil
+	}
+
+	s, ok := scalarString(raw)
+	if !ok {
+		return "", errors.Errorf(`field "%s" must be a string`, key)
+	}
+	return s, nil
+}
+
+// getStringMap reads an optional map of strings from a source or params map.
+func getStringMap(values map[string]interface{}, key string) (map[string]string, error) {
+	raw, ok := values[key]
+	if !ok || raw == nil {
+		return nil, nil
+	}
+
+	m, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil, errors.Errorf(`field "%s" must be a map of strings`, key)
+	}
+
+	strs := make(map[string]string, len(m))
+	for k, v := range m {
+		s, ok := scalarString(v)
+		if !ok {
+			return nil, errors.Errorf(`field "%s.%s" must be a string`, key, k)
+		}
+		strs[k] = s
+	}
+	return strs, nil
+}
+
+// getStringList reads an optional list of strings from a source or params map.
+func getStringList(values map[string]interface{}, key string) ([]string, error) {
+	raw, ok := values[key]
+	if !ok || raw == nil {
+		return nil, nil
+	}
+
+	list, ok := raw.([]interface{})
+	if !ok {
+		return nil, errors.Errorf(`field "%s" must be a list of strings`, key)
+	}
+
+	strs := make([]string, 0, len(list))
+	for _, v := range list {
+		s, ok := scalarString(v)
+		if !ok || s == "" {
+			return nil, errors.Errorf(`field "%s" must be a list of non-empty strings`, key)
+		}
+		strs = append(strs, s)
+	}
+	return strs, nil
+}
+
+// getBool reads an optional boolean from a source or params map.
+func getBool(values map[string]interface{}, key string) (bool, error) {
+	raw, ok := values[key]
+	if !ok || raw == nil {
+		return false, nil
+	}
+
+	switch v := raw.(type) {
+	case bool:
+		return v, nil
+	case string:
+		if b, err := strconv.ParseBool(v); err == nil {
+			return b, nil
+		}
+	}
+	return false, errors.Errorf(`field "%s" must be a boolean`, key)
+}
+
+// getBoolDefault reads an optional boolean from a source or params map, returning defaultValue when
+// the field is unset.
+func getBoolDefault(values map[string]interface{}, key string, defaultValue bool) (bool, error) {
+	if raw, ok := values[key]; !ok || raw == nil {
+		return defaultValue, nil
+	}
+	return getBool(values, key)
+}
+
+// getDuration reads an optional positive duration string such as "5s" from a source or params map,
+// returning defaultValue when the field is unset. A bare number such as 30 or "30" is in seconds.
+func getDuration(values map[string]interface{}, key string, defaultValue time.Duration) (time.Duration, error) {
+	raw, ok := values[key]
+	if !ok || raw == nil {
+		return defaultValue, nil
+	}
+
+	var d time.Duration
+	if seconds, ok := number(raw); ok {
+		if math.Abs(seconds) > math.MaxInt64/float64(time.Second) {
+			return 0, errors.Errorf(`field "%s" is too long a duration`, key)
+		}
+		d = time.Duration(seconds * float64(time.Second))
+	} else if s, ok := raw.(string); ok {
+		var err error
+		if d, err = time.ParseDuration(strings.TrimSpace(s)); err != nil {
+			return 0, errors.Wrapf(err, `field "%s" is not a valid duration`, key)
+		}
+	} else {
+		return 0, errors.Errorf(`field "%s" must be a duration such as "30s" or a number of seconds`, key)
+	}
+
+	if d <= 0 {
+		return 0, errors.Errorf(`field "%s" must be positive`, key)
+	}
+
+	return d, nil
+}
+
+// decodeBase64 decodes standard base64, ignoring the line breaks tools such as `base64` wrap their
+// output with.
+func decodeBase64(s string) (string, error) {
+	s = strings.Join(strings.Fields(s), "")
+	decoded, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return "", err
+	}
+	return string(decoded), nil
+}
+
+// getPositiveNumber reads an optional positive number from a source or params map, returning
+// defaultValue when the field is unset.
+func getPositiveNumber(values map[string]interface{}, key string, defaultValue float64) (float64, error) {
+	raw, ok := values[key]
+	if !ok || raw == nil {
+		return defaultValue, nil
+	}
+
+	n, ok := number(raw)
+	if !ok {
+		return 0, errors.Errorf(`field "%s" must be a number`, key)
+	}
+
+	if n <= 0 {
+		return 0, errors.Errorf(`field "%s" must be positive`, key)
+	}
+	return n, nil
+}
+
+// getNonNegativeInt reads an optional whole number that may be zero from a source or params map,
+// returning defaultValue when the field is unset.
+func getNonNegativeInt(values map[string]interface{}, key string, defaultValue int) (int, error) {
+	raw, ok := values[key]
+	if !ok || raw == nil {
+		return defaultValue, nil
+	}
+
+	f, ok := number(raw)
+	if !ok {
+		return 0, errors.Errorf(`field "%s" must be a number`, key)
+	}
+	n := int(f)
+	if f != float64(n) {
+		return 0, errors.Errorf(`field "%s" must be a whole number`, key)
+	}
+
+	if n < 0 {
+		return 0, errors.Errorf(`field "%s" must not be negative`, key)
+	}
+	return n, nil
+}
+
+// getBuildReasons reads an optional list of the reasons kpack gives for starting a build.
+func getBuildReasons(values map[string]interface{}, key string) ([]string, error) {
+	reasons, err := getStringList(values, key)
+	if err != nil {
+		return nil, err
+	}
+	for i, reason := range reasons {
+		reasons[i] = strings.ToUpper(reason)
+		switch reasons[i] {
+		case buildv1alpha1.BuildReasonConfig, buildv1alpha1.BuildReasonCommit, buildv1alpha1.BuildReasonBuildpack,
+			buildv1alpha1.BuildReasonStack:
+		default:
+			return nil, errors.Errorf(`field "%s" must only contain %s, %s, %s, or %s`, key,
+				buildv1alpha1.BuildReasonConfig, buildv1alpha1.BuildReasonCommit, buildv1alpha1.BuildReasonBuildpack,
+				buildv1alpha1.BuildReasonStack)
+		}
+	}
+	return reasons, nil
+}
+
+// scalarString reads a string field that the pipeline may have written as a YAML number or
+// boolean, such as a git revision of 1234 or a namespace of `true`, as the text it was written as.
+func scalarString(raw interface{}) (string, bool) {
+	switch v := raw.(type) {
+	case string:
+		return v, true
+	case bool:
+		return strconv.FormatBool(v), true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case int:
+		return strconv.Itoa(v), true
+	}
+	return "", false
+}
+
+// number reads a numeric field that the pipeline may have quoted, such as "5" instead of 5.
+func number(raw interface{}) (float64, bool) {
+	switch v := raw.(type) {
+	case float64:
+		return v, true
+	case int:
+		return float64(v), true
+	case string:
+		n, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		return n, err == nil && !math.IsNaN(n) && !math.IsInf(n, 0)
+	}
+	return 0, false
+}
+
+// InParams is the validated form of the `params` given to a get.
+type InParams struct {
+	// SaveLogs writes the complete log of the build to build.log in the output directory.
+	SaveLogs bool
+	// WriteFiles writes the version, image reference, and metadata files to the output directory.
+	// Defaults to true.
+	WriteFiles bool
+}
+
+// parseInParams validates the params given to In.
+func parseInParams(params oc.Params) (*InParams, error) {
+	var (
+		inParams = &InParams{}
+		err      error
+	)
+
+	if inParams.SaveLogs, err = getBool(params, "save_logs"); err != nil {
+		return nil, errors.WithMessage(err, "invalid params")
+	}
+	if inParams.WriteFiles, err = getBoolDefault(params, "write_files", true); err != nil {
+		return nil, errors.WithMessage(err, "invalid params")
+	}
+	if inParams.SaveLogs && !inParams.WriteFiles {
+		return nil, errors.New(`params field "save_logs" cannot be combined with "write_files: false"`)
+	}
+
+	return inParams, nil
+}
+
+// OutParams is the validated form of the `params` given to a put.
+type OutParams struct {
+	// CreateIfMissing is a path, relative to the input directory, to an image manifest that is
+	// created when the image does not exist yet.
+	CreateIfMissing string
+	// DryRun reports what the put would do without triggering a build.
+	DryRun bool
+	// SkipIfBuilding waits for a build that is already running instead of triggering another one.
+	// By default every put triggers a new build.
+	SkipIfBuilding bool
+	// SourceRevision is the git commit, tag, or branch to build, from the `source_revision` or
+	// `source_branch` param. The image's own revision is used when it is empty.
+	SourceRevision string
+	// Mode selects how a put builds: outModeImage triggers a rebuild of the Image itself, while
+	// outModeBuild creates a one-off Build from the image's spec and leaves the Image untouched.
+	// Defaults to outModeImage.
+	Mode string
+	// ShowEvents logs the Kubernetes events recorded for the image, its build, and the build's pod
+	// while the put waits for the build.
+	ShowEvents bool
+	// BuilderName points the image at another builder before the build, and BuilderKind, Builder or
+	// ClusterBuilder, says which kind it is. The image's current kind is kept when BuilderKind is
+	// empty.
+	BuilderName string
+	BuilderKind string
+	// Wait selects whether a put returns once the build it triggered has started, or only once it
+	// has finished. Defaults to waitFinish.
+	Wait string
+	// MinBuildNumber makes a put wait until a build at least this new has completed, so an older
+	// build's result is never returned.
+	MinBuildNumber int64
+	// CancelOnAbort deletes the build a put is following when the job is aborted, which stops it.
+	// By default the build keeps running.
+	CancelOnAbort bool
+	// Env sets build environment variables on the image for the build this put triggers. They
+	// replace any set by the previous put.
+	Env map[string]string
+	// FailOnNoop fails a put whose build produced the same image the put started from, and SkipNoop
+	// instead returns the version the put started from. By default the new build's version is
+	// returned either way.
+	FailOnNoop bool
+	SkipNoop   bool
+	// OnSuccessAnnotations are set on the image once the build this put follows has succeeded, to
+	// record release state in the cluster.
+	OnSuccessAnnotations map[string]string
+}
+
+// parseOutParams validates the params given to Out.
+func parseOutParams(params oc.Params) (*OutParams, error) {
+	var (
+		outParams = &OutParams{}
+		err       error
+	)
+
+	if outParams.CreateIfMissing, err = getString(params, "create_if_missing"); err != nil {
+		return nil, errors.WithMessage(err, "invalid params")
+	}
+	if outParams.DryRun, err = getBool(params, "dry_run"); err != nil {
+		return nil, errors.WithMessage(err, "invalid params")
+	}
+	if outParams.SkipIfBuilding, err = getBool(params, "skip_if_building"); err != nil {
+		return nil, errors.WithMessage(err, "invalid params")
+	}
+	minBuildNumber, err := getNonNegativeInt(params, "min_build_number", 0)
+	if err != nil {
+		return nil, errors.WithMessage(err, "invalid params")
+	}
+	outParams.MinBuildNumber = int64(minBuildNumber)
+
+	if outParams.CancelOnAbort, err = getBool(params, "cancel_on_abort"); err != nil {
+		return nil, errors.WithMessage(err, "invalid params")
+	}
+	if outParams.Env, err = getStringMap(params, "env"); err != nil {
+		return nil, errors.WithMessage(err, "invalid params")
+	}
+	if outParams.SourceRevision, err = getString(params, "source_revision"); err != nil {
+		return nil, errors.WithMessage(err, "invalid params")
+	}
+	branch, err := getString(params, "source_branch")
+	if err != nil {
+		return nil, errors.WithMessage(err, "invalid params")
+	}
+	if branch != "" {
+		if outParams.SourceRevision != "" {
+			return nil, errors.New(`params fields "source_revision" and "source_branch" are mutually exclusive`)
+		}
+		outParams.SourceRevision = branch
+	}
+
+	if outParams.Mode, err = getString(params, "out_mode"); err != nil {
+		return nil, errors.WithMessage(err, "invalid params")
+	}
+	switch outParams.Mode {
+	case "":
+		outParams.Mode = outModeImage
+	case outModeImage, outModeBuild:
+	default:
+		return nil, errors.Errorf(`params field "out_mode" must be "%s" or "%s"`, outModeImage, outModeBuild)
+	}
+
+	if outParams.ShowEvents, err = getBool(params, "show_events"); err != nil {
+		return nil, errors.WithMessage(err, "invalid params")
+	}
+
+	if outParams.BuilderName, err = getString(params, "builder_name"); err != nil {
+		return nil, errors.WithMessage(err, "invalid params")
+	}
+	if outParams.BuilderKind, err = getString(params, "builder_kind"); err != nil {
+		return nil, errors.WithMessage(err, "invalid params")
+	}
+	switch outParams.BuilderKind {
+	case "", "Builder", "ClusterBuilder":
+	default:
+		return nil, errors.New(`params field "builder_kind" must be "Builder" or "ClusterBuilder"`)
+	}
+	if outParams.BuilderKind != "" && outParams.BuilderName == "" {
+		return nil, errors.New(`params field "builder_kind" requires "builder_name"`)
+	}
+
+	if outParams.Wait, err = getString(params, "wait"); err != nil {
+		return nil, errors.WithMessage(err, "invalid params")
+	}
+	switch outParams.Wait {
+	case "":
+		outParams.Wait = waitFinish
+	case waitStart, waitFinish:
+	default:
+		return nil, errors.Errorf(`params field "wait" must be "%s" or "%s"`, waitStart, waitFinish)
+	}
+	if outParams.Wait == waitStart && outParams.Mode == outModeBuild {
+		return nil, errors.Errorf(`params field "wait: %s" cannot be combined with "out_mode: %s"`, waitStart, outModeBuild)
+	}
+	if outParams.Wait == waitStart && outParams.MinBuildNumber > 0 {
+		return nil, errors.Errorf(`params field "min_build_number" cannot be combined with "wait: %s"`, waitStart)
+	}
+
+	if outParams.FailOnNoop, err = getBool(params, "fail_on_noop"); err != nil {
+		return nil, errors.WithMessage(err, "invalid params")
+	}
+	if outParams.SkipNoop, err = getBool(params, "skip_noop"); err != nil {
+		return nil, errors.WithMessage(err, "invalid params")
+	}
+	if outParams.FailOnNoop && outParams.SkipNoop {
+		return nil, errors.New(`params fields "fail_on_noop" and "skip_noop" are mutually exclusive`)
+	}
+	// Only a put that waits for the image's build to finish can compare the image it produced.
+	noopField := ""
+	if outParams.FailOnNoop {
+		noopField = "fail_on_noop"
+	} else if outParams.SkipNoop {
+		noopField = "skip_noop"
+	}
+	if noopField != "" && outParams.Mode == outModeBuild {
+		return nil, errors.Errorf(`params field "%s" cannot be combined with "out_mode: %s"`, noopField, outModeBuild)
+	}
+	if noopField != "" && outParams.Wait == waitStart {
+		return nil, errors.Errorf(`params field "%s" cannot be combined with "wait: %s"`, noopField, waitStart)
+	}
+
+	if outParams.OnSuccessAnnotations, err = getStringMap(params, "on_success_annotations"); err != nil {
+		return nil, errors.WithMessage(err, "invalid params")
+	}
+	if len(outParams.OnSuccessAnnotations) > 0 && outParams.Mode == outModeBuild {
+		return nil, errors.Errorf(`params field "on_success_annotations" cannot be combined with "out_mode: %s"`, outModeBuild)
+	}
+	if len(outParams.OnSuccessAnnotations) > 0 && outParams.Wait == waitStart {
+		return nil, errors.Errorf(`params field "on_success_annotations" cannot be combined with "wait: %s"`, waitStart)
+	}
+
+	return outParams, nil
+}
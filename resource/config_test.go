@@ -0,0 +1,274 @@
+package resource
+
+import (
+	oc "github.com/cloudboss/ofcourse/ofcourse"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestParseSourceTriggerAnnotation(t *testing.T) {
+	config, err := parseSource(oc.Source{"image": "app"})
+	require.NoError(t, err)
+	require.Empty(t, config.TriggerAnnotation)
+
+	config, err = parseSource(oc.Source{"image": "app", "trigger_annotation": "example.com/rebuild"})
+	require.NoError(t, err)
+	require.Equal(t, "example.com/rebuild", config.TriggerAnnotation)
+
+	_, err = parseSource(oc.Source{"image": "app", "trigger_annotation": "not a key"})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `source field "trigger_annotation" is not a valid annotation key`)
+}
+
+func TestParseSourceLogLevel(t *testing.T) {
+	for level, streams := range map[string]bool{
+		"":       true,
+		"debug":  true,
+		"info":   true,
+		"warn":   false,
+		"error":  false,
+		"silent": false,
+		"quiet":  false,
+	} {
+		config, err := parseSource(oc.Source{"image": "app", "log_level": level})
+		require.NoError(t, err, level)
+		require.Equal(t, streams, streamsBuildLogs(config.LogLevel), level)
+	}
+
+	_, err := parseSource(oc.Source{"image": "app", "log_level": "verbose"})
+	require.EqualError(t, err, `source field "log_level" must be "debug", "info", "warn", "error", "silent", or "quiet"`)
+}
+
+func TestParseSourceAPIVersion(t *testing.T) {
+	config, err := parseSource(oc.Source{"image": "app"})
+	require.NoError(t, err)
+	require.Equal(t, "build.pivotal.io", config.APIGroup)
+	require.Equal(t, "v1alpha1", config.APIVersion)
+
+	config, err = parseSource(oc.Source{"image": "app", "api_group": "build.example.com", "api_version": "v1beta1"})
+	require.NoError(t, err)
+	require.Equal(t, "build.example.com", config.APIGroup)
+	require.Equal(t, "v1beta1", config.APIVersion)
+
+	_, err = parseSource(oc.Source{"image": "app", "api_version": "v1alpha2"})
+	require.EqualError(t, err, `source field "api_version" requires "api_group": kpack itself is only supported at v1alpha1`)
+}
+
+func TestParseSourceKubeconfigBase64(t *testing.T) {
+	kubeconfig := "apiVersion: v1\nkind: Config\n"
+	// base64 -w 16 output, wrapped across lines.
+	config, err := parseSource(oc.Source{"image": "app", "kubeconfig_base64": "YXBpVmVyc2lvbjog\ndjEKa2luZDogQ29u\nZmlnCg==\n"})
+	require.NoError(t, err)
+	require.Equal(t, kubeconfig, config.Kubeconfig)
+
+	_, err = parseSource(oc.Source{"image": "app", "kubeconfig_base64": "not base64!"})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `invalid source: field "kubeconfig_base64" is not valid base64`)
+
+	_, err = parseSource(oc.Source{"image": "app", "kubeconfig_base64": "ICAK"})
+	require.EqualError(t, err, `source field "kubeconfig_base64" must not decode to an empty kubeconfig`)
+
+	_, err = parseSource(oc.Source{"image": "app", "kubeconfig_base64": "YQ==", "kubeconfig": "a"})
+	require.EqualError(t, err, `source field "kubeconfig_base64" cannot be combined with "kubeconfig" or "kubeconfig_path"`)
+}
+
+func TestGetString(t *testing.T) {
+	for raw, want := range map[interface{}]string{
+		"main":  "main",
+		1234:    "1234",
+		1234.0:  "1234",
+		1.5:     "1.5",
+		true:    "true",
+		"":      "",
+		" v1 ":  " v1 ",
+		"false": "false",
+	} {
+		s, err := getString(map[string]interface{}{"field": raw}, "field")
+		require.NoError(t, err, raw)
+		require.Equal(t, want, s, raw)
+	}
+
+	s, err := getString(map[string]interface{}{"field": nil}, "field")
+	require.NoError(t, err)
+	require.Empty(t, s)
+
+	_, err = getString(map[string]interface{}{"field": []interface{}{"a"}}, "field")
+	require.EqualError(t, err, `field "field" must be a string`)
+}
+
+func TestGetBool(t *testing.T) {
+	for raw, want := range map[interface{}]bool{
+		true:    true,
+		false:   false,
+		"true":  true,
+		"TRUE":  true,
+		"false": false,
+		"1":     true,
+		"0":     false,
+	} {
+		b, err := getBool(map[string]interface{}{"field": raw}, "field")
+		require.NoError(t, err, raw)
+		require.Equal(t, want, b, raw)
+	}
+
+	for _, raw := range []interface{}{"yes", "", 1, 1.0} {
+		_, err := getBool(map[string]interface{}{"field": raw}, "field")
+		require.EqualError(t, err, `field "field" must be a boolean`, raw)
+	}
+
+	b, err := getBoolDefault(map[string]interface{}{}, "field", true)
+	require.NoError(t, err)
+	require.True(t, b)
+}
+
+func TestGetNumbers(t *testing.T) {
+	for raw, want := range map[interface{}]float64{
+		2:       2,
+		2.5:     2.5,
+		"2":     2,
+		" 2.5 ": 2.5,
+	} {
+		n, err := getPositiveNumber(map[string]interface{}{"field": raw}, "field", 1)
+		require.NoError(t, err, raw)
+		require.Equal(t, want, n, raw)
+	}
+
+	for _, raw := range []interface{}{"NaN", "Inf", "-Inf", "two", true} {
+		_, err := getPositiveNumber(map[string]interface{}{"field": raw}, "field", 1)
+		require.EqualError(t, err, `field "field" must be a number`, raw)
+	}
+
+	_, err := getPositiveNumber(map[string]interface{}{"field": 0}, "field", 1)
+	require.EqualError(t, err, `field "field" must be positive`)
+
+	n, err := getNonNegativeInt(map[string]interface{}{"field": "0"}, "field", 3)
+	require.NoError(t, err)
+	require.Equal(t, 0, n)
+
+	_, err = getNonNegativeInt(map[string]interface{}{"field": 1.5}, "field", 3)
+	require.EqualError(t, err, `field "field" must be a whole number`)
+
+	_, err = getNonNegativeInt(map[string]interface{}{"field": -1}, "field", 3)
+	require.EqualError(t, err, `field "field" must not be negative`)
+}
+
+func TestGetDuration(t *testing.T) {
+	for raw, want := range map[interface{}]time.Duration{
+		"5s":     5 * time.Second,
+		" 1m30s": 90 * time.Second,
+		30:       30 * time.Second,
+		"30":     30 * time.Second,
+		0.5:      500 * time.Millisecond,
+	} {
+		d, err := getDuration(map[string]interface{}{"field": raw}, "field", time.Minute)
+		require.NoError(t, err, raw)
+		require.Equal(t, want, d, raw)
+	}
+
+	d, err := getDuration(map[string]interface{}{"field": nil}, "field", time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, time.Minute, d)
+
+	for _, raw := range []interface{}{"0s", 0, "-5s", -5} {
+		_, err := getDuration(map[string]interface{}{"field": raw}, "field", time.Minute)
+		require.EqualError(t, err, `field "field" must be positive`, raw)
+	}
+
+	for _, raw := range []interface{}{"NaN", "Inf", "five seconds"} {
+		_, err := getDuration(map[string]interface{}{"field": raw}, "field", time.Minute)
+		require.Error(t, err, raw)
+		require.Contains(t, err.Error(), `field "field" is not a valid duration`, raw)
+	}
+
+	_, err = getDuration(map[string]interface{}{"field": 1e12}, "field", time.Minute)
+	require.EqualError(t, err, `field "field" is too long a duration`)
+
+	_, err = getDuration(map[string]interface{}{"field": true}, "field", time.Minute)
+	require.EqualError(t, err, `field "field" must be a duration such as "30s" or a number of seconds`)
+
+	config, err := parseSource(oc.Source{"image": "app", "poll_interval": 10})
+	require.NoError(t, err)
+	require.Equal(t, 10*time.Second, config.PollInterval)
+}
+
+func TestParseSourceDefaults(t *testing.T) {
+	config, err := parseSource(oc.Source{"image": "app"})
+	require.NoError(t, err)
+	require.Equal(t, trackImage, config.Track)
+	require.Equal(t, triggerOnRollback, config.TriggerOn)
+	require.Equal(t, defaultReadyCondition, config.ReadyCondition)
+	require.Equal(t, defaultPollInterval, config.PollInterval)
+	require.Equal(t, defaultMinPollInterval, config.MinPollInterval)
+	require.Equal(t, defaultBuildTimeout, config.BuildTimeout)
+	require.Equal(t, defaultCheckTimeout, config.CheckTimeout)
+	require.Equal(t, int64(defaultPageSize), config.PageSize)
+	require.True(t, config.RequireImage)
+}
+
+func TestParseSourceRejectsInvalidSource(t *testing.T) {
+	for _, test := range []struct {
+		source oc.Source
+		err    string
+	}{
+		{oc.Source{}, ErrMissingImage.Error()},
+		{oc.Source{"image": []interface{}{"app"}}, ErrMissingImage.Error()},
+		{oc.Source{"image": "app", "kubeconfig": map[string]interface{}{}}, ErrMissingKubeconfig.Error()},
+		{oc.Source{"image": "app", "namespace": []interface{}{}}, ErrMissingNamespace.Error()},
+		{oc.Source{"image": "app", "label_selector": "app=web"},
+			`source fields "image", "label_selector", and "images" are mutually exclusive`},
+		{oc.Source{"image": "app", "kubeconfig": "a", "kubeconfig_path": "b"},
+			`source fields "kubeconfig" and "kubeconfig_path" are mutually exclusive`},
+		{oc.Source{"image": "app", "api_server": "https://api.example.com"},
+			`source fields "api_server" and "token" must be set together`},
+		{oc.Source{"image": "app", "in_cluster": true, "api_server": "https://api.example.com", "token": "abc"},
+			`source field "in_cluster" cannot be combined with "api_server" or a kubeconfig`},
+		{oc.Source{"image": "app", "in_cluster": true, "kubeconfig": "a"},
+			`source field "in_cluster" cannot be combined with "api_server" or a kubeconfig`},
+		{oc.Source{"image": "app", "in_cluster": true, "kubeconfig_path": "/etc/kubeconfig"},
+			`source field "in_cluster" cannot be combined with "api_server" or a kubeconfig`},
+		{oc.Source{"image": "app", "namespace": "apps", "all_namespaces": true},
+			`source fields "namespace" and "all_namespaces" are mutually exclusive`},
+		{oc.Source{"image": "app", "track": "digest"}, `source field "track" must be "image", "source", or "sourceresolver"`},
+		{oc.Source{"image": "app", "poll_interval": "1s", "min_poll_interval": "2s"},
+			`source field "min_poll_interval" must not be greater than "poll_interval"`},
+		{oc.Source{"image": "app", "build_timeout": "soon"}, `invalid source: field "build_timeout" is not a valid duration`},
+	} {
+		_, err := parseSource(test.source)
+		require.Error(t, err, test.source)
+		require.Contains(t, err.Error(), test.err, test.source)
+	}
+}
+
+func TestParseOutParams(t *testing.T) {
+	outParams, err := parseOutParams(oc.Params{})
+	require.NoError(t, err)
+	require.Equal(t, waitFinish, outParams.Wait)
+	require.Equal(t, outModeImage, outParams.Mode)
+
+	outParams, err = parseOutParams(oc.Params{"wait": "start", "source_branch": "release"})
+	require.NoError(t, err)
+	require.Equal(t, waitStart, outParams.Wait)
+	require.Equal(t, "release", outParams.SourceRevision)
+
+	for _, test := range []struct {
+		params oc.Params
+		err    string
+	}{
+		{oc.Params{"wait": "ready"}, `params field "wait" must be "start" or "finish"`},
+		{oc.Params{"wait": "start", "out_mode": "build"}, `params field "wait: start" cannot be combined with "out_mode: build"`},
+		{oc.Params{"source_revision": "abc", "source_branch": "main"},
+			`params fields "source_revision" and "source_branch" are mutually exclusive`},
+		{oc.Params{"builder_kind": "Builder"}, `params field "builder_kind" requires "builder_name"`},
+		{oc.Params{"min_build_number": -1}, "invalid params"},
+		{oc.Params{"min_build_number": 3, "wait": "start"}, `params field "min_build_number" cannot be combined with "wait: start"`},
+		{oc.Params{"fail_on_noop": true, "wait": "start"}, `params field "fail_on_noop" cannot be combined with "wait: start"`},
+		{oc.Params{"skip_noop": true, "wait": "start"}, `params field "skip_noop" cannot be combined with "wait: start"`},
+		{oc.Params{"fail_on_noop": true, "out_mode": "build"}, `params field "fail_on_noop" cannot be combined with "out_mode: build"`},
+		{oc.Params{"skip_noop": true, "out_mode": "build"}, `params field "skip_noop" cannot be combined with "out_mode: build"`},
+	} {
+		_, err := parseOutParams(test.params)
+		require.Error(t, err, test.params)
+		require.Contains(t, err.Error(), test.err, test.params)
+	}
+}
@@ -0,0 +1,189 @@
+package resource
+
+import (
+	buildv1alpha1 "github.com/pivotal/kpack/pkg/apis/build/v1alpha1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
+)
+
+// dynamicClient implements ImageClient for forks of kpack that serve its resources under another
+// API group or version. Objects are read with the dynamic client and converted field by field to
+// kpack's types, so the fork's schema must match kpack's.
+type dynamicClient struct {
+	client       dynamic.Interface
+	gv           schema.GroupVersion
+	fieldManager string
+}
+
+// NewDynamicImageClient returns an ImageClient for the kpack resources served at gv that records
+// its writes as made by fieldManager.
+func NewDynamicImageClient(client dynamic.Interface, gv schema.GroupVersion, fieldManager string) ImageClient {
+	return &dynamicClient{client: client, gv: gv, fieldManager: fieldManager}
+}
+
+func (c *dynamicClient) resource(name string) dynamic.NamespaceableResourceInterface {
+	return c.client.Resource(c.gv.WithResource(name))
+}
+
+func (c *dynamicClient) GetImage(namespace, name string) (*buildv1alpha1.Image, error) {
+	u, err := c.resource("images").Namespace(namespace).Get(name, v1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	image := &buildv1alpha1.Image{}
+	return image, fromUnstructured(u.UnstructuredContent(), image)
+}
+
+func (c *dynamicClient) ListImages(namespace string, options v1.ListOptions) (*buildv1alpha1.ImageList, error) {
+	u, err := c.resource("images").Namespace(namespace).List(options)
+	if err != nil {
+		return nil, err
+	}
+	images := &buildv1alpha1.ImageList{}
+	return images, fromUnstructured(u.UnstructuredContent(), images)
+}
+
+func (c *dynamicClient) WatchImages(namespace string, options v1.ListOptions) (watch.Interface, error) {
+	w, err := c.resource("images").Namespace(namespace).Watch(options)
+	if err != nil {
+		return nil, err
+	}
+	return watch.Filter(w, func(event watch.Event) (watch.Event, bool) {
+		u, ok := event.Object.(*unstructured.Unstructured)
+		if !ok {
+			return event, true
+		}
+		image := &buildv1alpha1.Image{}
+		if err := fromUnstructured(u.UnstructuredContent(), image); err != nil {
+			return event, true
+		}
+		event.Object = image
+		return event, true
+	}), nil
+}
+
+func (c *dynamicClient) CreateImage(image *buildv1alpha1.Image) (*buildv1alpha1.Image, error) {
+	u, err := c.toUnstructured(image, "Image")
+	if err != nil {
+		return nil, err
+	}
+	u, err = c.resource("images").Namespace(image.Namespace).Create(u, v1.CreateOptions{FieldManager: c.fieldManager})
+	if err != nil {
+		return nil, err
+	}
+	created := &buildv1alpha1.Image{}
+	return created, fromUnstructured(u.UnstructuredContent(), created)
+}
+
+func (c *dynamicClient) UpdateImage(image *buildv1alpha1.Image) (*buildv1alpha1.Image, error) {
+	u, err := c.toUnstructured(image, "Image")
+	if err != nil {
+		return nil, err
+	}
+	u, err = c.resource("images").Namespace(image.Namespace).Update(u, v1.UpdateOptions{FieldManager: c.fieldManager})
+	if err != nil {
+		return nil, err
+	}
+	updated := &buildv1alpha1.Image{}
+	return updated, fromUnstructured(u.UnstructuredContent(), updated)
+}
+
+func (c *dynamicClient) PatchImage(namespace, name string, patch []byte) (*buildv1alpha1.Image, error) {
+	u, err := c.resource("images").Namespace(namespace).Patch(name, types.MergePatchType, patch, v1.PatchOptions{FieldManager: c.fieldManager})
+	if err != nil {
+		return nil, err
+	}
+	patched := &buildv1alpha1.Image{}
+	return patched, fromUnstructured(u.UnstructuredContent(), patched)
+}
+
+func (c *dynamicClient) GetBuild(namespace, name string) (*buildv1alpha1.Build, error) {
+	u, err := c.resource("builds").Namespace(namespace).Get(name, v1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	build := &buildv1alpha1.Build{}
+	return build, fromUnstructured(u.UnstructuredContent(), build)
+}
+
+func (c *dynamicClient) ListBuilds(namespace string, options v1.ListOptions) (*buildv1alpha1.BuildList, error) {
+	u, err := c.resource("builds").Namespace(namespace).List(options)
+	if err != nil {
+		return nil, err
+	}
+	builds := &buildv1alpha1.BuildList{}
+	return builds, fromUnstructured(u.UnstructuredContent(), builds)
+}
+
+func (c *dynamicClient) CreateBuild(build *buildv1alpha1.Build) (*buildv1alpha1.Build, error) {
+	u, err := c.toUnstructured(build, "Build")
+	if err != nil {
+		return nil, err
+	}
+	u, err = c.resource("builds").Namespace(build.Namespace).Create(u, v1.CreateOptions{FieldManager: c.fieldManager})
+	if err != nil {
+		return nil, err
+	}
+	created := &buildv1alpha1.Build{}
+	return created, fromUnstructured(u.UnstructuredContent(), created)
+}
+
+func (c *dynamicClient) PatchBuild(namespace, name string, patch []byte) (*buildv1alpha1.Build, error) {
+	u, err := c.resource("builds").Namespace(namespace).Patch(name, types.MergePatchType, patch, v1.PatchOptions{FieldManager: c.fieldManager})
+	if err != nil {
+		return nil, err
+	}
+	patched := &buildv1alpha1.Build{}
+	return patched, fromUnstructured(u.UnstructuredContent(), patched)
+}
+
+func (c *dynamicClient) DeleteBuild(namespace, name string) error {
+	return c.resource("builds").Namespace(namespace).Delete(name, &v1.DeleteOptions{})
+}
+
+func (c *dynamicClient) GetBuilder(namespace, name string) (*buildv1alpha1.Builder, error) {
+	u, err := c.resource("builders").Namespace(namespace).Get(name, v1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	builder := &buildv1alpha1.Builder{}
+	return builder, fromUnstructured(u.UnstructuredContent(), builder)
+}
+
+func (c *dynamicClient) GetClusterBuilder(name string) (*buildv1alpha1.ClusterBuilder, error) {
+	u, err := c.resource("clusterbuilders").Get(name, v1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	builder := &buildv1alpha1.ClusterBuilder{}
+	return builder, fromUnstructured(u.UnstructuredContent(), builder)
+}
+
+func (c *dynamicClient) GetSourceResolver(namespace, name string) (*buildv1alpha1.SourceResolver, error) {
+	u, err := c.resource("sourceresolvers").Namespace(namespace).Get(name, v1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	resolver := &buildv1alpha1.SourceResolver{}
+	return resolver, fromUnstructured(u.UnstructuredContent(), resolver)
+}
+
+// toUnstructured converts a kpack object to one of the given kind in the fork's API group.
+func (c *dynamicClient) toUnstructured(obj interface{}, kind string) (*unstructured.Unstructured, error) {
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+	if err != nil {
+		return nil, err
+	}
+	u := &unstructured.Unstructured{Object: content}
+	u.SetGroupVersionKind(c.gv.WithKind(kind))
+	return u, nil
+}
+
+func fromUnstructured(content map[string]interface{}, obj interface{}) error {
+	return runtime.DefaultUnstructuredConverter.FromUnstructured(content, obj)
+}
@@ -0,0 +1,83 @@
+package resource
+
+import (
+	buildv1alpha1 "github.com/pivotal/kpack/pkg/apis/build/v1alpha1"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	"sort"
+	"strings"
+	"time"
+)
+
+// putEnvAnnotation records which build environment variables were injected by the `env` put param,
+// so that the next put can remove them again instead of letting them accumulate.
+const putEnvAnnotation = "kpack-resource/put-env"
+
+// triggerEnvVar is the build environment variable Out sets to the time of the put to make kpack
+// rebuild an image. The pinned kpack only starts a build when the image's build config, source
+// revision, buildpacks, or stack change, so an annotation alone would not start one. The variable
+// is overwritten by every put rather than added again, so the spec does not grow.
+const triggerEnvVar = "KPACK_RESOURCE_TRIGGER"
+
+// setTrigger makes kpack start a new build of the image. With a trigger annotation, for kpack
+// versions or controllers that rebuild when it changes, the annotation is set instead of the build
+// env var.
+func setTrigger(image *buildv1alpha1.Image, annotation string, now time.Time) {
+	value := now.UTC().Format(time.RFC3339Nano)
+	if annotation != "" {
+		if image.Annotations == nil {
+			image.Annotations = map[string]string{}
+		}
+		image.Annotations[annotation] = value
+		return
+	}
+
+	for i := range image.Spec.Build.Env {
+		if image.Spec.Build.Env[i].Name == triggerEnvVar {
+			image.Spec.Build.Env[i].Value = value
+			return
+		}
+	}
+	image.Spec.Build.Env = append(image.Spec.Build.Env, corev1.EnvVar{Name: triggerEnvVar, Value: value})
+}
+
+// applyPutEnv replaces the variables injected by the previous put with env in the image's build
+// spec. kpack has no per-build environment, so the variables stay in the Image spec, and in every
+// build it starts, until the next put replaces or clears them. Variables the image defines itself
+// are never overridden.
+func applyPutEnv(image *buildv1alpha1.Image, env map[string]string) error {
+	injected := map[string]bool{}
+	if previous := image.Annotations[putEnvAnnotation]; previous != "" {
+		for _, name := range strings.Split(previous, ",") {
+			injected[name] = true
+		}
+	}
+
+	var kept []corev1.EnvVar
+	for _, envVar := range image.Spec.Build.Env {
+		if injected[envVar.Name] {
+			continue
+		}
+		if _, ok := env[envVar.Name]; ok {
+			return errors.Errorf("env var %s is already set in the spec of image %s", envVar.Name, image.Name)
+		}
+		kept = append(kept, envVar)
+	}
+
+	names := make([]string, 0, len(env))
+	for name := range env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		kept = append(kept, corev1.EnvVar{Name: name, Value: env[name]})
+	}
+	image.Spec.Build.Env = kept
+
+	if len(names) == 0 {
+		delete(image.Annotations, putEnvAnnotation)
+	} else {
+		image.Annotations[putEnvAnnotation] = strings.Join(names, ",")
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package resource
+
+import (
+	buildv1alpha1 "github.com/pivotal/kpack/pkg/apis/build/v1alpha1"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	"testing"
+	"time"
+)
+
+func TestSetTrigger(t *testing.T) {
+	image := &buildv1alpha1.Image{}
+	image.Spec.Build.Env = []corev1.EnvVar{{Name: "BP_JAVA_VERSION", Value: "11"}}
+
+	first := time.Date(2019, 10, 1, 12, 0, 0, 0, time.UTC)
+	setTrigger(image, "", first)
+	require.Equal(t, []corev1.EnvVar{
+		{Name: "BP_JAVA_VERSION", Value: "11"},
+		{Name: triggerEnvVar, Value: "2019-10-01T12:00:00Z"},
+	}, image.Spec.Build.Env)
+
+	setTrigger(image, "", first.Add(time.Second))
+	require.Equal(t, []corev1.EnvVar{
+		{Name: "BP_JAVA_VERSION", Value: "11"},
+		{Name: triggerEnvVar, Value: "2019-10-01T12:00:01Z"},
+	}, image.Spec.Build.Env, "a second put overwrites the variable rather than adding another")
+}
+
+func TestSetTriggerAnnotation(t *testing.T) {
+	image := &buildv1alpha1.Image{}
+
+	setTrigger(image, "example.com/rebuild", time.Date(2019, 10, 1, 12, 0, 0, 0, time.UTC))
+	require.Equal(t, map[string]string{"example.com/rebuild": "2019-10-01T12:00:00Z"}, image.Annotations)
+	require.Empty(t, image.Spec.Build.Env)
+}
+
+func TestApplyPutEnv(t *testing.T) {
+	image := &buildv1alpha1.Image{}
+	image.Name, image.Annotations = "app", map[string]string{}
+	image.Spec.Build.Env = []corev1.EnvVar{{Name: "BP_JAVA_VERSION", Value: "11"}}
+
+	require.NoError(t, applyPutEnv(image, map[string]string{"RELEASE": "1.2.0", "CHANNEL": "beta"}))
+	require.Equal(t, []corev1.EnvVar{
+		{Name: "BP_JAVA_VERSION", Value: "11"},
+		{Name: "CHANNEL", Value: "beta"},
+		{Name: "RELEASE", Value: "1.2.0"},
+	}, image.Spec.Build.Env)
+	require.Equal(t, "CHANNEL,RELEASE", image.Annotations[putEnvAnnotation])
+
+	// A later put replaces what the last one injected, and one without env removes it.
+	require.NoError(t, applyPutEnv(image, map[string]string{"RELEASE": "1.3.0"}))
+	require.Equal(t, []corev1.EnvVar{
+		{Name: "BP_JAVA_VERSION", Value: "11"},
+		{Name: "RELEASE", Value: "1.3.0"},
+	}, image.Spec.Build.Env)
+	require.NoError(t, applyPutEnv(image, nil))
+	require.Equal(t, []corev1.EnvVar{{Name: "BP_JAVA_VERSION", Value: "11"}}, image.Spec.Build.Env)
+	require.NotContains(t, image.Annotations, putEnvAnnotation)
+
+	err := applyPutEnv(image, map[string]string{"BP_JAVA_VERSION": "8"})
+	require.EqualError(t, err, "env var BP_JAVA_VERSION is already set in the spec of image app")
+}
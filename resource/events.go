@@ -0,0 +1,86 @@
+package resource
+
+import (
+	"context"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"strings"
+	"time"
+)
+
+// startEventTail logs the Kubernetes events recorded after since for an image, its numbered build,
+// and the build's pod, whose name starts with the build's, until it is stopped. Warnings are logged
+// as warnings. Without permission to watch events nothing is logged.
+func startEventTail(ctx context.Context, client ImageClient, k8sClient *kubernetes.Clientset, logger *Logger,
+	namespace, imageName string, number int64, since time.Time) *logTail {
+
+	ctx, cancel := context.WithCancel(ctx)
+	tail := &logTail{
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+
+	// Event timestamps only have second precision.
+	since = since.Truncate(time.Second)
+
+	go func() {
+		defer close(tail.done)
+
+		buildName := ""
+		if build, err := getNumberedBuild(client, namespace, imageName, number); err == nil && build != nil {
+			buildName = build.Name
+		}
+
+		w, err := k8sClient.CoreV1().Events(namespace).Watch(v1.ListOptions{})
+		if err != nil {
+			if k8serrors.IsForbidden(err) {
+				logger.Debugf("not allowed to watch events in namespace %s", namespace)
+			} else if ctx.Err() == nil {
+				logger.Warnf("could not watch events of image %s: %s", imageName, err)
+			}
+			return
+		}
+		defer w.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case e, ok := <-w.ResultChan():
+				if !ok {
+					return
+				}
+				event, ok := e.Object.(*corev1.Event)
+				if !ok || eventTime(event).Before(since) {
+					continue
+				}
+
+				name := event.InvolvedObject.Name
+				if name != imageName && (buildName == "" || !strings.HasPrefix(name, buildName)) {
+					continue
+				}
+				if event.Type == corev1.EventTypeWarning {
+					logger.Warnf("%s %s: %s: %s", event.InvolvedObject.Kind, name, event.Reason, event.Message)
+				} else {
+					logger.Infof("%s %s: %s: %s", event.InvolvedObject.Kind, name, event.Reason, event.Message)
+				}
+			}
+		}
+	}()
+
+	return tail
+}
+
+// eventTime is when an event last happened. Events from older components only set LastTimestamp,
+// and newer ones only EventTime.
+func eventTime(event *corev1.Event) time.Time {
+	if !event.LastTimestamp.IsZero() {
+		return event.LastTimestamp.Time
+	}
+	if !event.EventTime.IsZero() {
+		return event.EventTime.Time
+	}
+	return event.CreationTimestamp.Time
+}
@@ -0,0 +1,79 @@
+package resource
+
+import (
+	"context"
+	"encoding/json"
+	oc "github.com/cloudboss/ofcourse/ofcourse"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// testEvent is an event of type for the object of kind and name, last seen at.
+func testEvent(eventType, kind, name, reason string, at time.Time) *corev1.Event {
+	event := &corev1.Event{
+		InvolvedObject: corev1.ObjectReference{Kind: kind, Name: name, Namespace: "default"},
+		Reason:         reason,
+		Message:        reason + " " + name,
+		Type:           eventType,
+		LastTimestamp:  v1.NewTime(at),
+	}
+	event.Kind, event.APIVersion, event.Name = "Event", "v1", name+"."+reason
+	return event
+}
+
+func TestEventTail(t *testing.T) {
+	since := time.Date(2019, 10, 1, 12, 0, 0, 0, time.UTC)
+	events := []*corev1.Event{
+		testEvent(corev1.EventTypeNormal, "Image", "app", "Scheduled", since.Add(-time.Minute)),
+		testEvent(corev1.EventTypeNormal, "Image", "app", "Building", since.Add(time.Second)),
+		testEvent(corev1.EventTypeWarning, "Pod", "app-build-1-abcde-build-pod", "FailedScheduling", since.Add(time.Second)),
+		testEvent(corev1.EventTypeNormal, "Image", "web", "Building", since.Add(time.Second)),
+		testEvent(corev1.EventTypeNormal, "Pod", "app-build-2-fghij-build-pod", "Pulled", since.Add(time.Second)),
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/api/v1/namespaces/default/events", r.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		for _, event := range events {
+			require.NoError(t, encoder.Encode(map[string]interface{}{"type": watch.Added, "object": event}))
+		}
+	}))
+	defer server.Close()
+	k8sClient, err := kubernetes.NewForConfig(&rest.Config{Host: server.URL})
+	require.NoError(t, err)
+
+	c := newFakeImageClient()
+	c.addBuilds(testBuild(1, "registry/app@sha256:1", "abc"))
+
+	stderr := captureStderr(t, func() {
+		logger := newLogger(oc.NewLogger(oc.InfoLevel), &Config{})
+		tail := startEventTail(context.Background(), c, k8sClient, logger, "default", "app", 1, since)
+		tail.stop(5 * time.Second)
+	})
+	require.Contains(t, stderr, "Image app: Building: Building app")
+	require.Contains(t, stderr, "Pod app-build-1-abcde-build-pod: FailedScheduling: FailedScheduling app-build-1-abcde-build-pod")
+	require.NotContains(t, stderr, "Scheduled app", "recorded before the put")
+	require.NotContains(t, stderr, "web")
+	require.NotContains(t, stderr, "app-build-2")
+}
+
+func TestEventTimeFallsBack(t *testing.T) {
+	at := time.Date(2019, 10, 1, 12, 0, 0, 0, time.UTC)
+	event := &corev1.Event{}
+	event.CreationTimestamp = v1.NewTime(at)
+	require.Equal(t, at, eventTime(event))
+
+	event.EventTime = v1.NewMicroTime(at.Add(time.Second))
+	require.Equal(t, at.Add(time.Second), eventTime(event))
+
+	event.LastTimestamp = v1.NewTime(at.Add(time.Minute))
+	require.Equal(t, at.Add(time.Minute), eventTime(event))
+}
@@ -0,0 +1,206 @@
+package resource
+
+import (
+	buildv1alpha1 "github.com/pivotal/kpack/pkg/apis/build/v1alpha1"
+	"github.com/pivotal/kpack/pkg/client/clientset/versioned"
+	"github.com/pkg/errors"
+	"golang.org/x/net/http/httpproxy"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	_ "k8s.io/client-go/plugin/pkg/client/auth"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// connect builds the clients Check, In, and Out use. Tests replace it to run them against a fake.
+var connect = getKubeconfig
+
+// getKubeconfig builds the kpack and kubernetes clients for the cluster described by config. A
+// non-zero timeout bounds every request made with them, including watches. Unless every namespace
+// was asked for, an unset config.Namespace is filled in from the kubeconfig context, or "default".
+func getKubeconfig(logger *Logger, config *Config, timeout time.Duration) (ImageClient, *kubernetes.Clientset, error) {
+	clusterConfig, err := getClusterConfig(logger, config)
+	if err != nil {
+		return nil, nil, err
+	}
+	clusterConfig.Timeout = timeout
+
+	k8sClient, err := kubernetes.NewForConfig(clusterConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Failing here gives a clearer error than the first kpack request would.
+	if !config.SkipPrecheck {
+		if _, err := k8sClient.Discovery().ServerVersion(); err != nil {
+			return nil, nil, errors.Wrapf(err, "cannot reach Kubernetes API at %s", clusterConfig.Host)
+		}
+	}
+
+	if config.APIGroup != buildv1alpha1.SchemeGroupVersion.Group {
+		logger.Debugf("using the dynamic client for %s/%s", config.APIGroup, config.APIVersion)
+		dynamicClient, err := dynamic.NewForConfig(clusterConfig)
+		if err != nil {
+			return nil, nil, err
+		}
+		gv := schema.GroupVersion{Group: config.APIGroup, Version: config.APIVersion}
+		client := NewDynamicImageClient(dynamicClient, gv, config.FieldManager)
+		if err := checkBuildNamespace(client, config); err != nil {
+			return nil, nil, err
+		}
+		return client, k8sClient, nil
+	}
+
+	clientset, err := versioned.NewForConfig(clusterConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	client := NewImageClient(clientset, config.FieldManager)
+	if err := checkBuildNamespace(client, config); err != nil {
+		return nil, nil, err
+	}
+	return client, k8sClient, nil
+}
+
+// checkBuildNamespace makes sure builds can be listed in the `build_namespace`, so that a missing
+// permission there is reported up front rather than as a missing build.
+func checkBuildNamespace(client ImageClient, config *Config) error {
+	if config.BuildNamespace == "" || config.SkipPrecheck {
+		return nil
+	}
+	if _, err := client.ListBuilds(config.BuildNamespace, v1.ListOptions{Limit: 1}); err != nil {
+		return errors.Wrapf(err, "cannot list builds in namespace %s", config.BuildNamespace)
+	}
+	return nil
+}
+
+// getClusterConfig builds the rest config used to talk to the cluster from a bearer token, a
+// kubeconfig file, or an inline kubeconfig. When none is given, or `in_cluster` is set, the pod's
+// service account is used instead.
+func getClusterConfig(logger *Logger, config *Config) (*rest.Config, error) {
+	var (
+		clusterConfig *rest.Config
+		err           error
+	)
+	switch {
+	case config.APIServer != "":
+		clusterConfig = &rest.Config{
+			Host:        config.APIServer,
+			BearerToken: config.Token,
+			TLSClientConfig: rest.TLSClientConfig{
+				CAData: []byte(config.CACert),
+			},
+		}
+	case config.InCluster || (config.Kubeconfig == "" && config.KubeconfigPath == ""):
+		logger.Debugf("using in-cluster config")
+		clusterConfig, err = rest.InClusterConfig()
+		if err != nil {
+			return nil, errors.Wrap(err, "no kubeconfig provided and in-cluster config unavailable")
+		}
+	case config.KubeconfigPath != "":
+		loader := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+			&clientcmd.ClientConfigLoadingRules{ExplicitPath: config.KubeconfigPath},
+			&clientcmd.ConfigOverrides{CurrentContext: config.Context},
+		)
+		clusterConfig, err = contextConfig(loader, config)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to load kubeconfig from %s", config.KubeconfigPath)
+		}
+	default:
+		kubeconfig, err := clientcmd.Load([]byte(config.Kubeconfig))
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to parse kubeconfig")
+		}
+		loader := clientcmd.NewNonInteractiveClientConfig(*kubeconfig, config.Context,
+			&clientcmd.ConfigOverrides{CurrentContext: config.Context}, nil)
+		clusterConfig, err = contextConfig(loader, config)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to parse kubeconfig")
+		}
+	}
+
+	if config.Namespace == "" && !config.AllNamespaces {
+		config.Namespace = v1.NamespaceDefault
+	}
+
+	if config.InsecureSkipTLSVerify {
+		logger.Warnf("WARNING: insecure_skip_tls_verify is set, the API server's certificate will not be verified")
+		clusterConfig.TLSClientConfig.Insecure = true
+		clusterConfig.TLSClientConfig.CAData = nil
+		clusterConfig.TLSClientConfig.CAFile = ""
+	}
+
+	if config.ImpersonateUser != "" {
+		clusterConfig.Impersonate = rest.ImpersonationConfig{
+			UserName: config.ImpersonateUser,
+			Groups:   config.ImpersonateGroups,
+		}
+	}
+
+	clusterConfig.QPS = config.APIQPS
+	clusterConfig.Burst = config.APIBurst
+	clusterConfig.UserAgent = config.UserAgent
+	wrapTransport := clusterConfig.WrapTransport
+	clusterConfig.WrapTransport = func(rt http.RoundTripper) http.RoundTripper {
+		if t, ok := rt.(*http.Transport); ok {
+			t = t.Clone()
+			t.Proxy = proxyFunc(config)
+			rt = t
+		}
+		if wrapTransport != nil {
+			rt = wrapTransport(rt)
+		}
+		return &retryTransport{
+			next:    rt,
+			retries: config.APIRetries,
+			backoff: config.APIRetryBackoff,
+		}
+	}
+
+	return clusterConfig, nil
+}
+
+// contextConfig builds the rest config for the context of a kubeconfig named in config, or for its
+// current context, and takes the namespace from that context when config has none.
+func contextConfig(loader clientcmd.ClientConfig, config *Config) (*rest.Config, error) {
+	if config.Context != "" {
+		kubeconfig, err := loader.RawConfig()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := kubeconfig.Contexts[config.Context]; !ok {
+			return nil, errors.Errorf(`context "%s" does not exist`, config.Context)
+		}
+	}
+
+	if config.Namespace == "" && !config.AllNamespaces {
+		namespace, _, err := loader.Namespace()
+		if err != nil {
+			return nil, err
+		}
+		config.Namespace = namespace
+	}
+	return loader.ClientConfig()
+}
+
+// proxyFunc picks the proxy for API server requests. The HTTP(S)_PROXY and NO_PROXY environment
+// variables are honoured, with `https_proxy` and `no_proxy` from source taking precedence.
+func proxyFunc(config *Config) func(*http.Request) (*url.URL, error) {
+	proxyConfig := httpproxy.FromEnvironment()
+	if config.HTTPSProxy != "" {
+		proxyConfig.HTTPSProxy = config.HTTPSProxy
+	}
+	if config.NoProxy != "" {
+		proxyConfig.NoProxy = config.NoProxy
+	}
+	proxy := proxyConfig.ProxyFunc()
+	return func(req *http.Request) (*url.URL, error) {
+		return proxy(req.URL)
+	}
+}
@@ -0,0 +1,211 @@
+package resource
+
+import (
+	oc "github.com/cloudboss/ofcourse/ofcourse"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"k8s.io/client-go/rest"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+// testKubeconfig has a current context, dev, for a cluster at https://dev.example.com with namespace
+// apps, and a second context, prod, without a namespace.
+const testKubeconfig = `apiVersion: v1
+kind: Config
+clusters:
+- name: dev
+  cluster:
+    server: https://dev.example.com
+- name: prod
+  cluster:
+    server: https://prod.example.com
+users:
+- name: ci
+  user:
+    token: secret
+contexts:
+- name: dev
+  context:
+    cluster: dev
+    user: ci
+    namespace: apps
+- name: prod
+  context:
+    cluster: prod
+    user: ci
+current-context: dev
+`
+
+// testClusterConfig parses source and builds the cluster config for it.
+func testClusterConfig(t *testing.T, source oc.Source) (*Config, *rest.Config, error) {
+	config, err := parseSource(source)
+	require.NoError(t, err)
+	clusterConfig, err := getClusterConfig(newLogger(oc.NewLogger(oc.SilentLevel), config), config)
+	return config, clusterConfig, err
+}
+
+func TestGetClusterConfig(t *testing.T) {
+	_, clusterConfig, err := testClusterConfig(t, oc.Source{"image": "app", "kubeconfig": testKubeconfig})
+	require.NoError(t, err)
+	require.Equal(t, "https://dev.example.com", clusterConfig.Host)
+	require.Equal(t, "secret", clusterConfig.BearerToken)
+
+	file, err := ioutil.TempFile("", "kubeconfig")
+	require.NoError(t, err)
+	defer os.Remove(file.Name())
+	_, err = file.WriteString(testKubeconfig)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	_, clusterConfig, err = testClusterConfig(t, oc.Source{"image": "app", "kubeconfig_path": file.Name()})
+	require.NoError(t, err)
+	require.Equal(t, "https://dev.example.com", clusterConfig.Host)
+
+	_, clusterConfig, err = testClusterConfig(t, oc.Source{"image": "app", "api_server": "https://api.example.com", "token": "abc"})
+	require.NoError(t, err)
+	require.Equal(t, "https://api.example.com", clusterConfig.Host)
+	require.Equal(t, "abc", clusterConfig.BearerToken)
+
+	_, _, err = testClusterConfig(t, oc.Source{"image": "app", "kubeconfig": "not: [a kubeconfig"})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "failed to parse kubeconfig")
+}
+
+func TestProxyFunc(t *testing.T) {
+	proxy := proxyFunc(&Config{HTTPSProxy: "http://proxy.example.com:3128", NoProxy: "internal.example.com"})
+
+	req, err := http.NewRequest(http.MethodGet, "https://api.example.com/apis", nil)
+	require.NoError(t, err)
+	proxyURL, err := proxy(req)
+	require.NoError(t, err)
+	require.Equal(t, "http://proxy.example.com:3128", proxyURL.String())
+
+	req, err = http.NewRequest(http.MethodGet, "https://internal.example.com/apis", nil)
+	require.NoError(t, err)
+	proxyURL, err = proxy(req)
+	require.NoError(t, err)
+	require.Nil(t, proxyURL)
+}
+
+func TestClusterConfigTransport(t *testing.T) {
+	config, clusterConfig, err := testClusterConfig(t, oc.Source{"image": "app", "kubeconfig": testKubeconfig,
+		"https_proxy": "http://proxy.example.com:3128", "api_retries": 2})
+	require.NoError(t, err)
+
+	rt := clusterConfig.WrapTransport(&http.Transport{})
+	retry, ok := rt.(*retryTransport)
+	require.True(t, ok)
+	require.Equal(t, 2, retry.retries)
+	require.Equal(t, config.APIRetryBackoff, retry.backoff)
+
+	transport, ok := retry.next.(*http.Transport)
+	require.True(t, ok)
+	req, err := http.NewRequest(http.MethodGet, "https://dev.example.com/apis", nil)
+	require.NoError(t, err)
+	proxyURL, err := transport.Proxy(req)
+	require.NoError(t, err)
+	require.Equal(t, "http://proxy.example.com:3128", proxyURL.String())
+}
+
+func TestInsecureSkipTLSVerify(t *testing.T) {
+	_, clusterConfig, err := testClusterConfig(t, oc.Source{"image": "app", "kubeconfig": testKubeconfig})
+	require.NoError(t, err)
+	require.False(t, clusterConfig.Insecure)
+
+	_, clusterConfig, err = testClusterConfig(t, oc.Source{"image": "app", "kubeconfig": testKubeconfig,
+		"insecure_skip_tls_verify": "true"})
+	require.NoError(t, err)
+	require.True(t, clusterConfig.Insecure)
+	require.Empty(t, clusterConfig.CAData)
+	require.Empty(t, clusterConfig.CAFile)
+}
+
+func TestKubeconfigContext(t *testing.T) {
+	_, clusterConfig, err := testClusterConfig(t, oc.Source{"image": "app", "kubeconfig": testKubeconfig, "context": "prod"})
+	require.NoError(t, err)
+	require.Equal(t, "https://prod.example.com", clusterConfig.Host)
+
+	_, _, err = testClusterConfig(t, oc.Source{"image": "app", "kubeconfig": testKubeconfig, "context": "staging"})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `context "staging" does not exist`)
+
+	_, err = parseSource(oc.Source{"image": "app", "context": "prod"})
+	require.EqualError(t, err, `source field "context" requires "kubeconfig" or "kubeconfig_path"`)
+}
+
+func TestPrecheck(t *testing.T) {
+	healthy := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !healthy || r.URL.Path != "/version" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"major": "1", "minor": "15", "gitVersion": "v1.15.3"}`))
+	}))
+	defer server.Close()
+
+	source := oc.Source{"image": "app", "api_server": server.URL, "token": "abc", "api_retries": 0}
+	config, err := parseSource(source)
+	require.NoError(t, err)
+	_, _, err = getKubeconfig(newLogger(oc.NewLogger(oc.SilentLevel), config), config, time.Second)
+	require.NoError(t, err)
+
+	healthy = false
+	config, err = parseSource(source)
+	require.NoError(t, err)
+	_, _, err = getKubeconfig(newLogger(oc.NewLogger(oc.SilentLevel), config), config, time.Second)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "cannot reach Kubernetes API at "+server.URL)
+
+	source["skip_precheck"] = true
+	config, err = parseSource(source)
+	require.NoError(t, err)
+	_, _, err = getKubeconfig(newLogger(oc.NewLogger(oc.SilentLevel), config), config, time.Second)
+	require.NoError(t, err)
+}
+
+func TestImpersonation(t *testing.T) {
+	_, clusterConfig, err := testClusterConfig(t, oc.Source{"image": "app", "kubeconfig": testKubeconfig,
+		"impersonate_user": "system:serviceaccount:ci:deployer", "impersonate_groups": []interface{}{"deployers"}})
+	require.NoError(t, err)
+	require.Equal(t, "system:serviceaccount:ci:deployer", clusterConfig.Impersonate.UserName)
+	require.Equal(t, []string{"deployers"}, clusterConfig.Impersonate.Groups)
+
+	_, err = parseSource(oc.Source{"image": "app", "impersonate_groups": []interface{}{"deployers"}})
+	require.EqualError(t, err, `source field "impersonate_groups" requires "impersonate_user"`)
+}
+
+func TestNamespaceFromKubeconfigContext(t *testing.T) {
+	config, _, err := testClusterConfig(t, oc.Source{"image": "app", "kubeconfig": testKubeconfig})
+	require.NoError(t, err)
+	require.Equal(t, "apps", config.Namespace)
+
+	config, _, err = testClusterConfig(t, oc.Source{"image": "app", "kubeconfig": testKubeconfig, "context": "prod"})
+	require.NoError(t, err)
+	require.Equal(t, "default", config.Namespace)
+
+	config, _, err = testClusterConfig(t, oc.Source{"image": "app", "kubeconfig": testKubeconfig, "namespace": "ci"})
+	require.NoError(t, err)
+	require.Equal(t, "ci", config.Namespace)
+
+	// Every namespace is only searched when asked for.
+	config, _, err = testClusterConfig(t, oc.Source{"image": "app", "kubeconfig": testKubeconfig, "all_namespaces": true})
+	require.NoError(t, err)
+	require.Empty(t, config.Namespace)
+}
+
+func TestUserAgent(t *testing.T) {
+	_, clusterConfig, err := testClusterConfig(t, oc.Source{"image": "app", "kubeconfig": testKubeconfig})
+	require.NoError(t, err)
+	require.Equal(t, "kpack-resource/"+Version, clusterConfig.UserAgent)
+
+	_, clusterConfig, err = testClusterConfig(t, oc.Source{"image": "app", "kubeconfig": testKubeconfig,
+		"user_agent": "ci-pipeline/1.0"})
+	require.NoError(t, err)
+	require.Equal(t, "ci-pipeline/1.0", clusterConfig.UserAgent)
+}
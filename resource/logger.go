@@ -0,0 +1,101 @@
+package resource
+
+import (
+	"encoding/json"
+	"fmt"
+	oc "github.com/cloudboss/ofcourse/ofcourse"
+	"io"
+	"os"
+	"time"
+)
+
+// Logger writes the resource's own operational logs, either as text through the ofcourse logger or,
+// with `log_format: json`, as one JSON object per line. Build logs always go through the embedded
+// ofcourse logger as text.
+type Logger struct {
+	*oc.Logger
+
+	// json receives JSON log entries. Logs are written as text when it is nil.
+	json io.Writer
+	// level is the `log_level` JSON entries are written at, ordered as in logLevels.
+	level  string
+	fields map[string]string
+}
+
+// newLogger wraps the ofcourse logger according to the log settings in config.
+func newLogger(logger *oc.Logger, config *Config) *Logger {
+	l := &Logger{Logger: logger}
+	if config.LogFormat == logFormatJSON {
+		l.json = os.Stderr
+		l.level = config.LogLevel
+		if l.level == logLevelQuiet {
+			// ofcourse writes text logs at info for quiet, so JSON logs match them.
+			l.level = logLevelInfo
+		}
+		l.fields = map[string]string{}
+		if config.Namespace != "" {
+			l.fields["namespace"] = config.Namespace
+		}
+		if config.Image != "" {
+			l.fields["image"] = config.Image
+		}
+	}
+	return l
+}
+
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	if l.json == nil {
+		l.Logger.Debugf(format, args...)
+	} else if l.logs(logLevelDebug) {
+		l.writeJSON("debug", format, args...)
+	}
+}
+
+func (l *Logger) Infof(format string, args ...interface{}) {
+	if l.json == nil {
+		l.Logger.Infof(format, args...)
+	} else if l.logs(logLevelInfo) {
+		l.writeJSON("info", format, args...)
+	}
+}
+
+func (l *Logger) Warnf(format string, args ...interface{}) {
+	if l.json == nil {
+		l.Logger.Warnf(format, args...)
+	} else if l.logs(logLevelWarn) {
+		l.writeJSON("warn", format, args...)
+	}
+}
+
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	if l.json == nil {
+		l.Logger.Errorf(format, args...)
+	} else if l.logs(logLevelError) {
+		l.writeJSON("error", format, args...)
+	}
+}
+
+// logs reports whether JSON entries at level are written, which they are at the configured
+// `log_level` and every level less verbose than it.
+func (l *Logger) logs(level string) bool {
+	return logLevels[level] >= logLevels[l.level]
+}
+
+func (l *Logger) writeJSON(level, format string, args ...interface{}) {
+	entry, err := json.Marshal(struct {
+		Time    string            `json:"time"`
+		Level   string            `json:"level"`
+		Message string            `json:"message"`
+		Fields  map[string]string `json:"fields,omitempty"`
+	}{
+		Time:    time.Now().UTC().Format(time.RFC3339Nano),
+		Level:   level,
+		Message: fmt.Sprintf(format, args...),
+		Fields:  l.fields,
+	})
+	if err != nil {
+		l.Logger.Errorf("could not encode log entry: %s", err)
+		return
+	}
+	fmt.Fprintf(l.json, "%s\n", entry)
+}
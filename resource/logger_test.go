@@ -0,0 +1,65 @@
+package resource
+
+import (
+	"encoding/json"
+	oc "github.com/cloudboss/ofcourse/ofcourse"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+)
+
+func TestJSONLogger(t *testing.T) {
+	out := captureStderr(t, func() {
+		config := &Config{LogFormat: logFormatJSON, LogLevel: logLevelInfo, Namespace: "default", Image: "app"}
+		logger := newLogger(oc.NewLogger(oc.InfoLevel), config)
+		logger.Infof("built %s", "registry/app@sha256:1")
+		logger.Debugf("not logged")
+	})
+
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	require.Len(t, lines, 1)
+	var entry struct {
+		Time    string
+		Level   string
+		Message string
+		Fields  map[string]string
+	}
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &entry))
+	require.NotEmpty(t, entry.Time)
+	require.Equal(t, "info", entry.Level)
+	require.Equal(t, "built registry/app@sha256:1", entry.Message)
+	require.Equal(t, map[string]string{"namespace": "default", "image": "app"}, entry.Fields)
+
+	out = captureStderr(t, func() {
+		config := &Config{LogFormat: logFormatJSON, LogLevel: logLevelDebug}
+		newLogger(oc.NewLogger(oc.DebugLevel), config).Debugf("logged")
+	})
+	require.Contains(t, out, `"level":"debug","message":"logged"`)
+}
+
+func TestJSONLoggerRespectsLevel(t *testing.T) {
+	out := captureStderr(t, func() {
+		config := &Config{LogFormat: logFormatJSON, LogLevel: logLevelError}
+		logger := newLogger(oc.NewLogger(oc.ErrorLevel), config)
+		logger.Infof("not logged")
+		logger.Warnf("not logged either")
+	})
+	require.Empty(t, out)
+
+	out = captureStderr(t, func() {
+		config := &Config{LogFormat: logFormatJSON, LogLevel: logLevelWarn}
+		logger := newLogger(oc.NewLogger(oc.WarnLevel), config)
+		logger.Infof("not logged")
+		logger.Warnf("logged")
+		logger.Errorf("also logged")
+	})
+	require.NotContains(t, out, "not logged")
+	require.Contains(t, out, `"level":"warn","message":"logged"`)
+	require.Contains(t, out, `"level":"error","message":"also logged"`)
+
+	out = captureStderr(t, func() {
+		config := &Config{LogFormat: logFormatJSON, LogLevel: logLevelSilent}
+		newLogger(oc.NewLogger(oc.SilentLevel), config).Errorf("not logged")
+	})
+	require.Empty(t, out)
+}
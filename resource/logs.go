@@ -0,0 +1,355 @@
+package resource
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	oc "github.com/cloudboss/ofcourse/ofcourse"
+	buildv1alpha1 "github.com/pivotal/kpack/pkg/apis/build/v1alpha1"
+	"github.com/pkg/errors"
+	"io"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// logDrainTimeout is how long Out lets a build's log stream finish after the build completes.
+	logDrainTimeout = 10 * time.Second
+	// logReconnects bounds how many times a dropped log stream is re-attached, logReconnectDelay
+	// apart.
+	logReconnects     = 5
+	logReconnectDelay = 2 * time.Second
+	// logStopTimeout bounds how long Out waits for a cancelled log stream to exit.
+	logStopTimeout = 5 * time.Second
+)
+
+// logLevels orders the values of the `log_level` source field from most to least verbose.
+var logLevels = map[string]int{
+	logLevelDebug:  0,
+	logLevelInfo:   1,
+	logLevelQuiet:  2,
+	logLevelWarn:   2,
+	logLevelError:  3,
+	logLevelSilent: 4,
+}
+
+// streamsBuildLogs reports whether build logs are streamed at a log level.
+func streamsBuildLogs(level string) bool {
+	return logLevels[level] <= logLevels[logLevelInfo]
+}
+
+// logInfoWriter forwards build logs to the Concourse output at info level one line at a time,
+// dropping them when the configured level is above info. A partial line is held until the rest
+// of it is written or the writer is closed.
+type logInfoWriter struct {
+	logger *oc.Logger
+	level  string
+	buf    []byte
+}
+
+func newLogInfoWriter(logger *oc.Logger, level string) *logInfoWriter {
+	return &logInfoWriter{logger: logger, level: level}
+}
+
+func (l *logInfoWriter) Write(p []byte) (n int, err error) {
+	if !streamsBuildLogs(l.level) {
+		return len(p), nil
+	}
+
+	l.buf = append(l.buf, p...)
+	for {
+		i := bytes.IndexByte(l.buf, '\n')
+		if i < 0 {
+			break
+		}
+		l.logger.Infof("%s", l.buf[:i])
+		l.buf = l.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// Close flushes a trailing partial line.
+func (l *logInfoWriter) Close() error {
+	if len(l.buf) > 0 {
+		l.logger.Infof("%s", l.buf)
+		l.buf = nil
+	}
+	return nil
+}
+
+// logTail streams a build's logs to the Concourse output in the background.
+type logTail struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func startLogTail(ctx context.Context, k8sClient *kubernetes.Clientset, logger *Logger, level string,
+	image, build, namespace string) *logTail {
+
+	ctx, cancel := context.WithCancel(ctx)
+	tail := &logTail{
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+
+	go func() {
+		defer close(tail.done)
+		w := newLogInfoWriter(logger.Logger, level)
+		defer w.Close()
+
+		follower := &logFollower{
+			source:     &clusterPodLogs{k8sClient: k8sClient},
+			w:          w,
+			logger:     logger,
+			reconnects: logReconnects,
+			delay:      logReconnectDelay,
+		}
+		if err := follower.follow(ctx, image, build, namespace); err != nil && ctx.Err() == nil {
+			logger.Errorf(err.Error())
+		}
+	}()
+
+	return tail
+}
+
+// stop gives the log stream up to grace to drain, then cancels it and waits up to logStopTimeout
+// for it to exit so that nothing is written to the logger after Out returns.
+func (t *logTail) stop(grace time.Duration) {
+	select {
+	case <-t.done:
+	case <-time.After(grace):
+	}
+
+	t.cancel()
+	select {
+	case <-t.done:
+	case <-time.After(logStopTimeout):
+	}
+}
+
+// podLogSource finds the pod of a build and opens the logs of its containers.
+type podLogSource interface {
+	buildPod(namespace, image, build string) (*corev1.Pod, error)
+	openLogs(ctx context.Context, pod *corev1.Pod, container string) (io.ReadCloser, error)
+}
+
+type clusterPodLogs struct {
+	k8sClient kubernetes.Interface
+}
+
+// buildPod returns the pod kpack runs the numbered build of an image in, or nil before there is one.
+func (c *clusterPodLogs) buildPod(namespace, image, build string) (*corev1.Pod, error) {
+	pods, err := c.k8sClient.CoreV1().Pods(namespace).List(v1.ListOptions{
+		LabelSelector: labels.SelectorFromSet(labels.Set{
+			buildv1alpha1.ImageLabel:       image,
+			buildv1alpha1.BuildNumberLabel: build,
+		}).String(),
+	})
+	if err != nil || len(pods.Items) == 0 {
+		return nil, err
+	}
+	return &pods.Items[0], nil
+}
+
+func (c *clusterPodLogs) openLogs(ctx context.Context, pod *corev1.Pod, container string) (io.ReadCloser, error) {
+	return c.k8sClient.CoreV1().Pods(pod.Namespace).GetLogs(pod.Name, &corev1.PodLogOptions{
+		Container: container,
+		Follow:    true,
+	}).Context(ctx).Stream()
+}
+
+// logFollower writes the logs of every step of a build, in order, as the steps run. A log stream
+// that fails or ends while its step is still running is opened again, up to reconnects times in a
+// row, delay apart. The logs are then read from the start of the step, skipping the lines already
+// written, so no step is cut short or repeated.
+type logFollower struct {
+	source     podLogSource
+	w          io.Writer
+	logger     *Logger
+	reconnects int
+	delay      time.Duration
+}
+
+func (f *logFollower) follow(ctx context.Context, image, build, namespace string) error {
+	written := map[string]int{}
+	finished := map[string]bool{}
+	failures := 0
+
+	for {
+		pod, err := f.source.buildPod(namespace, image, build)
+		if err == nil && pod != nil {
+			var done, progressed bool
+			done, progressed, err = f.followPod(ctx, pod, written, finished)
+			if done {
+				return nil
+			}
+			if progressed {
+				failures = 0
+			}
+			// A step that wrote logs and ended has most likely finished, so the next one is looked
+			// for straight away.
+			if err == nil && progressed {
+				continue
+			}
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			if failures == f.reconnects {
+				return errors.Wrapf(err, "lost the logs of build %s of image %s", build, image)
+			}
+			failures++
+			f.logger.Debugf("log stream of build %s of image %s dropped, reconnecting: %s", build, image, err)
+		}
+		if err := sleep(ctx, f.delay); err != nil {
+			return nil
+		}
+	}
+}
+
+// followPod streams the steps of pod that have not finished yet, in order, stopping at the first
+// that has not started. done reports that every step has finished, and progressed that any log
+// lines were written.
+func (f *logFollower) followPod(ctx context.Context, pod *corev1.Pod, written map[string]int,
+	finished map[string]bool) (done, progressed bool, err error) {
+
+	podDone := pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed
+	states := map[string]corev1.ContainerState{}
+	for _, status := range append(pod.Status.InitContainerStatuses, pod.Status.ContainerStatuses...) {
+		states[status.Name] = status.State
+	}
+
+	for _, container := range append(pod.Spec.InitContainers, pod.Spec.Containers...) {
+		name := container.Name
+		if finished[name] {
+			continue
+		}
+		state, ok := states[name]
+		if !ok || state.Waiting != nil {
+			// A step that never started because an earlier one failed has no logs.
+			if podDone {
+				finished[name] = true
+				continue
+			}
+			return false, progressed, nil
+		}
+
+		lines, err := f.streamContainer(ctx, pod, name, written[name], state.Terminated != nil)
+		written[name] += lines
+		progressed = progressed || lines > 0
+		if err != nil {
+			return false, progressed, err
+		}
+		// Logs opened after the step terminated are complete. Otherwise the stream may have ended
+		// before the step did, so the pod is read again to find out.
+		if state.Terminated == nil {
+			if lines == 0 {
+				return false, progressed, errors.Errorf("log stream of step %s ended while it was running", name)
+			}
+			return false, progressed, nil
+		}
+		finished[name] = true
+	}
+	return true, progressed, nil
+}
+
+// streamContainer writes the logs of a step, skipping the first skip lines, and returns the number
+// of lines it wrote. A trailing partial line is only written when the step has terminated, as
+// otherwise it is read again in full after reconnecting.
+func (f *logFollower) streamContainer(ctx context.Context, pod *corev1.Pod, container string, skip int,
+	terminated bool) (int, error) {
+
+	stream, err := f.source.openLogs(ctx, pod, container)
+	if err != nil {
+		return 0, err
+	}
+	defer stream.Close()
+
+	r := bufio.NewReader(stream)
+	read, lines := 0, 0
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF && len(line) > 0 && terminated {
+			line, err = append(line, '\n'), nil
+		}
+		if err == io.EOF {
+			return lines, nil
+		}
+		if err != nil {
+			return lines, err
+		}
+
+		read++
+		if read <= skip {
+			continue
+		}
+		if _, err := fmt.Fprintf(f.w, "[%s] %s", cyan(container), line); err != nil {
+			return lines, err
+		}
+		lines++
+	}
+}
+
+func cyan(s string) string {
+	return fmt.Sprintf("\033[0;36m%s\033[0m", s)
+}
+
+// saveBuildLogs writes the logs of every step of a completed build to path. kpack runs each build
+// step as an init container of the build pod, so the steps are read in order.
+func saveBuildLogs(k8sClient *kubernetes.Clientset, build *buildv1alpha1.Build, path string) error {
+	if build.Status.PodName == "" {
+		return errors.Errorf("build %s has no pod", build.Name)
+	}
+
+	pod, err := k8sClient.CoreV1().Pods(build.Namespace).Get(build.Status.PodName, v1.GetOptions{})
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := writeBuildLogs(k8sClient, pod, f); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// writeBuildLogs copies the logs of every step of a build pod to w.
+func writeBuildLogs(k8sClient *kubernetes.Clientset, pod *corev1.Pod, w io.Writer) error {
+	for _, container := range pod.Spec.InitContainers {
+		err := copyContainerLogs(k8sClient, pod, container.Name, w)
+		if err != nil {
+			return errors.Wrapf(err, "failed to read logs for step %s", container.Name)
+		}
+	}
+	return nil
+}
+
+func copyContainerLogs(k8sClient *kubernetes.Clientset, pod *corev1.Pod, container string, w io.Writer) error {
+	stream, err := k8sClient.CoreV1().Pods(pod.Namespace).GetLogs(pod.Name, &corev1.PodLogOptions{
+		Container: container,
+	}).Stream()
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	_, err = fmt.Fprintf(w, "===> %s\n", strings.ToUpper(container))
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(w, stream)
+	return err
+}
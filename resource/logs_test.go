@@ -0,0 +1,225 @@
+package resource
+
+import (
+	"bytes"
+	"context"
+	oc "github.com/cloudboss/ofcourse/ofcourse"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"io"
+	"io/ioutil"
+	corev1 "k8s.io/api/core/v1"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakePodLogs serves a build pod whose state advances every time it is read, and log streams from
+// a queue per container. A nil entry in a queue fails that attempt to open the logs.
+type fakePodLogs struct {
+	pods  []*corev1.Pod
+	reads int
+	logs  map[string][]*string
+	opens map[string]int
+	block bool
+}
+
+func (f *fakePodLogs) buildPod(namespace, image, build string) (*corev1.Pod, error) {
+	i := f.reads
+	if i >= len(f.pods) {
+		i = len(f.pods) - 1
+	}
+	f.reads++
+	return f.pods[i], nil
+}
+
+func (f *fakePodLogs) openLogs(ctx context.Context, pod *corev1.Pod, container string) (io.ReadCloser, error) {
+	if f.block {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	if f.opens == nil {
+		f.opens = map[string]int{}
+	}
+	queue := f.logs[container]
+	i := f.opens[container]
+	f.opens[container]++
+	if i >= len(queue) {
+		i = len(queue) - 1
+	}
+	if queue[i] == nil {
+		return nil, errors.New("connection reset by peer")
+	}
+	return ioutil.NopCloser(strings.NewReader(*queue[i])), nil
+}
+
+func logs(s string) *string {
+	return &s
+}
+
+// buildPod is a pod whose steps are running or terminated as given, in order.
+func buildPod(phase corev1.PodPhase, steps ...string) *corev1.Pod {
+	pod := &corev1.Pod{}
+	pod.Status.Phase = phase
+	for _, step := range steps {
+		name, state := step, corev1.ContainerState{Running: &corev1.ContainerStateRunning{}}
+		switch {
+		case strings.HasSuffix(step, ":done"):
+			name, state = strings.TrimSuffix(step, ":done"), corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{}}
+		case strings.HasSuffix(step, ":waiting"):
+			name, state = strings.TrimSuffix(step, ":waiting"), corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{}}
+		}
+		pod.Spec.InitContainers = append(pod.Spec.InitContainers, corev1.Container{Name: name})
+		pod.Status.InitContainerStatuses = append(pod.Status.InitContainerStatuses, corev1.ContainerStatus{Name: name, State: state})
+	}
+	return pod
+}
+
+func followLogs(t *testing.T, source *fakePodLogs) string {
+	var out bytes.Buffer
+	follower := &logFollower{
+		source:     source,
+		w:          &out,
+		logger:     &Logger{Logger: oc.NewLogger(oc.SilentLevel)},
+		reconnects: 2,
+		delay:      time.Millisecond,
+	}
+	require.NoError(t, follower.follow(context.Background(), "app", "1", "default"))
+	return strings.NewReplacer(cyan("build"), "build", cyan("export"), "export").Replace(out.String())
+}
+
+func TestLogFollowerStreamsStepsInOrder(t *testing.T) {
+	out := followLogs(t, &fakePodLogs{
+		pods: []*corev1.Pod{buildPod(corev1.PodSucceeded, "build:done", "export:done")},
+		logs: map[string][]*string{
+			"build":  {logs("compiling\nbuilt")},
+			"export": {logs("exported\n")},
+		},
+	})
+	require.Equal(t, "[build] compiling\n[build] built\n[export] exported\n", out)
+}
+
+func TestLogFollowerReconnectsAfterAnError(t *testing.T) {
+	source := &fakePodLogs{
+		pods: []*corev1.Pod{buildPod(corev1.PodSucceeded, "build:done")},
+		logs: map[string][]*string{
+			"build": {nil, logs("compiling\n")},
+		},
+	}
+	require.Equal(t, "[build] compiling\n", followLogs(t, source))
+	require.Equal(t, 2, source.opens["build"])
+}
+
+func TestLogFollowerResumesADroppedStep(t *testing.T) {
+	source := &fakePodLogs{
+		pods: []*corev1.Pod{
+			buildPod(corev1.PodRunning, "build", "export:waiting"),
+			buildPod(corev1.PodRunning, "build", "export:waiting"),
+			buildPod(corev1.PodSucceeded, "build:done", "export:done"),
+		},
+		logs: map[string][]*string{
+			// The first stream drops mid-line while the step is still running.
+			"build":  {logs("one\ntw"), logs("one\ntwo\nthree\n")},
+			"export": {logs("exported\n")},
+		},
+	}
+	require.Equal(t, "[build] one\n[build] two\n[build] three\n[export] exported\n", followLogs(t, source))
+}
+
+func TestLogFollowerSkipsStepsAfterAFailure(t *testing.T) {
+	out := followLogs(t, &fakePodLogs{
+		pods: []*corev1.Pod{buildPod(corev1.PodFailed, "build:done", "export:waiting")},
+		logs: map[string][]*string{
+			"build": {logs("failed\n")},
+		},
+	})
+	require.Equal(t, "[build] failed\n", out)
+}
+
+func TestLogFollowerGivesUp(t *testing.T) {
+	follower := &logFollower{
+		source: &fakePodLogs{
+			pods: []*corev1.Pod{buildPod(corev1.PodRunning, "build")},
+			logs: map[string][]*string{"build": {nil}},
+		},
+		w:          ioutil.Discard,
+		logger:     &Logger{Logger: oc.NewLogger(oc.SilentLevel)},
+		reconnects: 2,
+		delay:      time.Millisecond,
+	}
+	err := follower.follow(context.Background(), "app", "1", "default")
+	require.EqualError(t, err, "lost the logs of build 1 of image app: connection reset by peer")
+}
+
+func TestLogTailStopDoesNotHang(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	tail := &logTail{cancel: cancel, done: make(chan struct{})}
+	go func() {
+		defer close(tail.done)
+		follower := &logFollower{
+			source: &fakePodLogs{
+				pods:  []*corev1.Pod{buildPod(corev1.PodRunning, "build")},
+				block: true,
+			},
+			w:      ioutil.Discard,
+			logger: &Logger{Logger: oc.NewLogger(oc.SilentLevel)},
+			delay:  time.Millisecond,
+		}
+		follower.follow(ctx, "app", "1", "default")
+	}()
+
+	stopped := make(chan struct{})
+	go func() {
+		tail.stop(10 * time.Millisecond)
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("stop did not return after the log stream was cancelled")
+	}
+}
+
+func TestLogInfoWriter(t *testing.T) {
+	out := captureStderr(t, func() {
+		w := newLogInfoWriter(oc.NewLogger(oc.InfoLevel), logLevelInfo)
+		w.Write([]byte("first\nsec"))
+		w.Write([]byte("ond\nthird"))
+		w.Close()
+	})
+	require.Equal(t, "\033[1;32mfirst\033[0m\n\033[1;32msecond\033[0m\n\033[1;32mthird\033[0m\n", out)
+
+	out = captureStderr(t, func() {
+		w := newLogInfoWriter(oc.NewLogger(oc.InfoLevel), logLevelQuiet)
+		w.Write([]byte("dropped\n"))
+		w.Close()
+	})
+	require.Empty(t, out)
+}
+
+func TestLogInfoWriterKeepsBlankLines(t *testing.T) {
+	out := captureStderr(t, func() {
+		w := newLogInfoWriter(oc.NewLogger(oc.InfoLevel), logLevelInfo)
+		n, err := w.Write([]byte("a\n\nb\n"))
+		require.NoError(t, err)
+		require.Equal(t, 5, n)
+		w.Close()
+	})
+	require.Equal(t, "\033[1;32ma\033[0m\n\033[1;32m\033[0m\n\033[1;32mb\033[0m\n", out)
+}
+
+// captureStderr returns what f writes to stderr, where the ofcourse logger writes.
+func captureStderr(t *testing.T, f func()) string {
+	r, w, err := os.Pipe()
+	require.NoError(t, err)
+	stderr := os.Stderr
+	os.Stderr = w
+	defer func() { os.Stderr = stderr }()
+
+	f()
+	require.NoError(t, w.Close())
+	out, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	return string(out)
+}
@@ -0,0 +1,328 @@
+package resource
+
+import (
+	"fmt"
+	oc "github.com/cloudboss/ofcourse/ofcourse"
+	buildv1alpha1 "github.com/pivotal/kpack/pkg/apis/build/v1alpha1"
+	"github.com/pkg/errors"
+	"knative.dev/pkg/apis/duck/v1alpha1"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// splitImageRef splits an image reference such as `registry/app@sha256:...` into the tag it was
+// pushed to and its digest. The digest is empty when the reference does not contain one.
+func splitImageRef(ref string) (tag, digest string) {
+	i := strings.LastIndex(ref, "@")
+	if i < 0 {
+		return ref, ""
+	}
+	return ref[:i], ref[i+1:]
+}
+
+// sameImage reports whether two image references name the same image. kpack may report one digest
+// under different tags, so references that both carry a digest are compared by digest alone.
+func sameImage(a, b string) bool {
+	_, digestA := splitImageRef(a)
+	_, digestB := splitImageRef(b)
+	if digestA != "" && digestB != "" {
+		return digestA == digestB
+	}
+	return a == b
+}
+
+// renameMetadata renames metadata entries as configured by the `metadata_keys` source field, which
+// maps default names such as gitRevision to the names a team prefers. Other entries keep their
+// default names.
+func renameMetadata(metadata oc.Metadata, keys map[string]string) oc.Metadata {
+	if len(keys) == 0 {
+		return metadata
+	}
+
+	renamed := make(oc.Metadata, 0, len(metadata))
+	for _, entry := range metadata {
+		if name, ok := keys[entry.Name]; ok {
+			entry.Name = name
+		}
+		renamed = append(renamed, entry)
+	}
+	return renamed
+}
+
+// imageRefMetadata describes the tag and, when known, the digest of an image reference.
+func imageRefMetadata(tag, digest string) oc.Metadata {
+	metadata := oc.Metadata{
+		{
+			Name:  "imageTag",
+			Value: tag,
+		},
+	}
+	if digest != "" {
+		metadata = append(metadata, oc.NameVal{
+			Name:  "imageDigest",
+			Value: digest,
+		})
+	}
+	return metadata
+}
+
+// sourceMetadata describes whichever of the git, blob, or registry sources is configured.
+func sourceMetadata(source buildv1alpha1.SourceConfig) oc.Metadata {
+	switch {
+	case source.Git != nil:
+		return oc.Metadata{
+			{
+				Name:  "gitUrl",
+				Value: source.Git.URL,
+			},
+			{
+				Name:  "gitRevision",
+				Value: source.Git.Revision,
+			},
+		}
+	case source.Blob != nil:
+		return oc.Metadata{
+			{
+				Name:  "blobUrl",
+				Value: source.Blob.URL,
+			},
+		}
+	case source.Registry != nil:
+		return oc.Metadata{
+			{
+				Name:  "registryImage",
+				Value: source.Registry.Image,
+			},
+		}
+	default:
+		return oc.Metadata{}
+	}
+}
+
+// imageMetadata describes the source and latest build of an image.
+func imageMetadata(image *buildv1alpha1.Image) oc.Metadata {
+	metadata := sourceMetadata(image.Spec.Source)
+	metadata = append(metadata, imageRefMetadata(splitImageRef(image.Status.LatestImage))...)
+	metadata = append(metadata, imageRepositoryMetadata(image)...)
+	return append(metadata, imageGenerationMetadata(image)...)
+}
+
+// imageRepositoryMetadata records the repository an image is configured to publish to, which,
+// unlike imageTag, does not depend on any one build.
+func imageRepositoryMetadata(image *buildv1alpha1.Image) oc.Metadata {
+	if image.Spec.Tag == "" {
+		return nil
+	}
+	return oc.Metadata{
+		{
+			Name:  "imageRepository",
+			Value: image.Spec.Tag,
+		},
+	}
+}
+
+// imageGenerationMetadata records the generation of the image's spec, which the API server bumps on
+// every spec change, so that a build can be matched with the spec it came from. It is left out of
+// the version so that an edit that does not produce a new image does not trigger jobs.
+func imageGenerationMetadata(image *buildv1alpha1.Image) oc.Metadata {
+	if image.Generation == 0 {
+		return nil
+	}
+	return oc.Metadata{
+		{
+			Name:  "imageGeneration",
+			Value: strconv.FormatInt(image.Generation, 10),
+		},
+	}
+}
+
+// buildMetadata describes why and how a build ran, and the pod it ran in.
+func buildMetadata(build *buildv1alpha1.Build) oc.Metadata {
+	// kpack records why it started a build, e.g. COMMIT or STACK, in an annotation.
+	reason := build.Annotations[buildv1alpha1.BuildReasonAnnotation]
+	if reason == "" {
+		reason = "UNKNOWN"
+	}
+
+	metadata := oc.Metadata{
+		{
+			Name:  "buildReason",
+			Value: reason,
+		},
+	}
+
+	if build.Status.PodName != "" {
+		metadata = append(metadata, oc.Metadata{
+			{
+				Name:  "buildPod",
+				Value: build.Status.PodName,
+			},
+		}...)
+	}
+
+	if duration, ok := buildDuration(build); ok {
+		metadata = append(metadata, oc.Metadata{
+			{
+				Name:  "buildDuration",
+				Value: duration.String(),
+			},
+		}...)
+	}
+
+	if len(build.Status.BuildMetadata) > 0 {
+		buildpacks := make([]string, 0, len(build.Status.BuildMetadata))
+		for _, buildpack := range build.Status.BuildMetadata {
+			buildpacks = append(buildpacks, fmt.Sprintf("%s@%s", buildpack.ID, buildpack.Version))
+		}
+		metadata = append(metadata, oc.Metadata{
+			{
+				Name:  "buildpacks",
+				Value: strings.Join(buildpacks, ","),
+			},
+		}...)
+	}
+
+	if cached, ok := buildCached(build); ok {
+		metadata = append(metadata, oc.Metadata{
+			{
+				Name:  "cached",
+				Value: strconv.FormatBool(cached),
+			},
+		}...)
+	}
+	return metadata
+}
+
+// buildCached reports whether a build restored layers from its image's build cache. A build uses
+// the cache when kpack mounted one and a previous build could have filled it, and it is only known
+// to have done so once its restore step completed.
+func buildCached(build *buildv1alpha1.Build) (bool, bool) {
+	if build.Spec.CacheName == "" || build.Spec.LastBuild.Image == "" {
+		return false, true
+	}
+	for _, step := range build.Status.StepsCompleted {
+		if step == "restore" {
+			return true, true
+		}
+	}
+	return false, false
+}
+
+// resolvedRevisionMetadata records the commit a build was made from. kpack resolves an image's
+// revision, which may be a branch or tag, to a commit before creating a build, so the build's
+// source carries the exact commit. Without a build, the requested source's revision is used.
+func resolvedRevisionMetadata(build *buildv1alpha1.Build, requested buildv1alpha1.SourceConfig) oc.Metadata {
+	source := requested
+	if build != nil && build.Spec.Source.Git != nil && build.Spec.Source.Git.Revision != "" {
+		source = build.Spec.Source
+	}
+	if source.Git == nil || source.Git.Revision == "" {
+		return oc.Metadata{}
+	}
+
+	return oc.Metadata{
+		{
+			Name:  "resolvedRevision",
+			Value: source.Git.Revision,
+		},
+	}
+}
+
+// previousImageMetadata records the image an image's previous successful build produced, if any.
+func previousImageMetadata(ref string) oc.Metadata {
+	if ref == "" {
+		return oc.Metadata{}
+	}
+	return oc.Metadata{
+		{
+			Name:  "previousImage",
+			Value: ref,
+		},
+	}
+}
+
+// requestedRevisionMetadata records the revision a put asked to build, if any.
+func requestedRevisionMetadata(revision string) oc.Metadata {
+	if revision == "" {
+		return oc.Metadata{}
+	}
+	return oc.Metadata{
+		{
+			Name:  "requestedRevision",
+			Value: revision,
+		},
+	}
+}
+
+// buildCountMetadata numbers a build among all the builds kpack has run for its image.
+func buildCountMetadata(build *buildv1alpha1.Build, image *buildv1alpha1.Image) oc.Metadata {
+	return oc.Metadata{
+		{
+			Name:  "buildNumber",
+			Value: strconv.FormatInt(buildNumber(build), 10),
+		},
+		{
+			Name:  "totalBuilds",
+			Value: strconv.FormatInt(image.Status.BuildCounter, 10),
+		},
+	}
+}
+
+// buildDuration is the time from a build's creation until it succeeded or failed. It is not known
+// while the build is still running.
+func buildDuration(build *buildv1alpha1.Build) (time.Duration, bool) {
+	succeeded := build.Status.GetCondition(v1alpha1.ConditionSucceeded)
+	if !succeeded.IsTrue() && !succeeded.IsFalse() {
+		return 0, false
+	}
+
+	finished := succeeded.LastTransitionTime.Inner
+	if finished.IsZero() || build.CreationTimestamp.IsZero() {
+		return 0, false
+	}
+	return finished.Sub(build.CreationTimestamp.Time).Round(time.Second), true
+}
+
+// builderMetadata describes the builder an image is configured with and the run image of the stack
+// that builder currently provides.
+func builderMetadata(client ImageClient, image *buildv1alpha1.Image) (oc.Metadata, error) {
+	metadata := oc.Metadata{
+		{
+			Name:  "builder",
+			Value: fmt.Sprintf("%s/%s", image.Spec.Builder.Kind, image.Spec.Builder.Name),
+		},
+	}
+
+	status, err := builderStatus(client, image)
+	if err != nil {
+		return metadata, err
+	}
+
+	return append(metadata, oc.NameVal{
+		Name:  "runImage",
+		Value: status.RunImage,
+	}), nil
+}
+
+// builderStatus looks up the status of the Builder or ClusterBuilder an image is configured with.
+// kpack treats an image without a builder kind as using a namespaced Builder.
+func builderStatus(client ImageClient, image *buildv1alpha1.Image) (buildv1alpha1.BuilderStatus, error) {
+	switch image.Spec.Builder.Kind {
+	case buildv1alpha1.ClusterBuilderKind:
+		builder, err := client.GetClusterBuilder(image.Spec.Builder.Name)
+		if err != nil {
+			return buildv1alpha1.BuilderStatus{}, err
+		}
+		return builder.Status, nil
+	case buildv1alpha1.BuilderKind, "":
+		builder, err := client.GetBuilder(image.Namespace, image.Spec.Builder.Name)
+		if err != nil {
+			return buildv1alpha1.BuilderStatus{}, err
+		}
+		return builder.Status, nil
+	default:
+		return buildv1alpha1.BuilderStatus{}, errors.Errorf("image %s has unknown builder kind %q, expected %q or %q",
+			image.Name, image.Spec.Builder.Kind, buildv1alpha1.BuilderKind, buildv1alpha1.ClusterBuilderKind)
+	}
+}
@@ -0,0 +1,195 @@
+package resource
+
+import (
+	oc "github.com/cloudboss/ofcourse/ofcourse"
+	buildv1alpha1 "github.com/pivotal/kpack/pkg/apis/build/v1alpha1"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"knative.dev/pkg/apis"
+	"testing"
+	"time"
+)
+
+func TestImageRefMetadata(t *testing.T) {
+	tag, digest := splitImageRef("registry.example.com:5000/team/app@sha256:abc")
+	require.Equal(t, "registry.example.com:5000/team/app", tag)
+	require.Equal(t, "sha256:abc", digest)
+	require.Equal(t, oc.Metadata{{Name: "imageTag", Value: tag}, {Name: "imageDigest", Value: digest}},
+		imageRefMetadata(tag, digest))
+
+	tag, digest = splitImageRef("registry.example.com:5000/team/app:latest")
+	require.Equal(t, "registry.example.com:5000/team/app:latest", tag)
+	require.Empty(t, digest)
+	require.Equal(t, oc.Metadata{{Name: "imageTag", Value: tag}}, imageRefMetadata(tag, digest))
+}
+
+func TestSourceMetadata(t *testing.T) {
+	require.Equal(t, oc.Metadata{{Name: "blobUrl", Value: "https://example.com/app.tgz"}},
+		sourceMetadata(buildv1alpha1.SourceConfig{Blob: &buildv1alpha1.Blob{URL: "https://example.com/app.tgz"}}))
+	require.Equal(t, oc.Metadata{{Name: "registryImage", Value: "registry/source:1"}},
+		sourceMetadata(buildv1alpha1.SourceConfig{Registry: &buildv1alpha1.Registry{Image: "registry/source:1"}}))
+	require.Equal(t, oc.Metadata{{Name: "gitUrl", Value: "https://github.com/example/app"}, {Name: "gitRevision", Value: "main"}},
+		sourceMetadata(testImage().Spec.Source))
+	require.Empty(t, sourceMetadata(buildv1alpha1.SourceConfig{}))
+}
+
+func TestBuildReasonMetadata(t *testing.T) {
+	build := testBuild(1, "registry/app@sha256:1", "abc")
+	require.Equal(t, oc.NameVal{Name: "buildReason", Value: "UNKNOWN"}, buildMetadata(&build)[0])
+
+	build.Annotations = map[string]string{buildv1alpha1.BuildReasonAnnotation: "COMMIT,STACK"}
+	require.Equal(t, oc.NameVal{Name: "buildReason", Value: "COMMIT,STACK"}, buildMetadata(&build)[0])
+}
+
+func TestBuilderMetadata(t *testing.T) {
+	c := newFakeImageClient()
+	image := testImage()
+
+	metadata, err := builderMetadata(c, image)
+	require.Error(t, err)
+	require.Equal(t, oc.Metadata{{Name: "builder", Value: "ClusterBuilder/default"}}, metadata)
+
+	builder := &buildv1alpha1.ClusterBuilder{}
+	builder.Name = "default"
+	builder.Status.RunImage = "registry/run@sha256:1"
+	c.clusterBuilders["default"] = builder
+	metadata, err = builderMetadata(c, image)
+	require.NoError(t, err)
+	require.Equal(t, oc.Metadata{
+		{Name: "builder", Value: "ClusterBuilder/default"},
+		{Name: "runImage", Value: "registry/run@sha256:1"},
+	}, metadata)
+}
+
+func TestBuildDuration(t *testing.T) {
+	build := testBuild(1, "registry/app@sha256:1", "abc")
+	_, ok := buildDuration(&build)
+	require.False(t, ok, "finish time unknown")
+
+	finished := build.CreationTimestamp.Add(90*time.Second + 400*time.Millisecond)
+	build.Status.Conditions[0].LastTransitionTime = apis.VolatileTime{Inner: v1.NewTime(finished)}
+	duration, ok := buildDuration(&build)
+	require.True(t, ok)
+	require.Equal(t, 90*time.Second, duration)
+	require.Contains(t, buildMetadata(&build), oc.NameVal{Name: "buildDuration", Value: "1m30s"})
+
+	build.Status.Conditions[0].Status = corev1.ConditionUnknown
+	_, ok = buildDuration(&build)
+	require.False(t, ok, "still running")
+}
+
+func TestBuildCountMetadata(t *testing.T) {
+	builds := []buildv1alpha1.Build{testBuild(3, "registry/app@sha256:3", "abc"), testBuild(5, "", "def")}
+	require.Equal(t, oc.Metadata{{Name: "buildNumber", Value: "3"}, {Name: "totalBuilds", Value: "5"}},
+		buildCountMetadata(&builds[0], testImage(builds...)))
+}
+
+func TestResolvedRevisionMetadata(t *testing.T) {
+	requested := testImage().Spec.Source
+	build := testBuild(1, "registry/app@sha256:1", "0123abc")
+
+	require.Equal(t, oc.Metadata{{Name: "resolvedRevision", Value: "0123abc"}}, resolvedRevisionMetadata(&build, requested))
+	require.Equal(t, oc.Metadata{{Name: "resolvedRevision", Value: "main"}}, resolvedRevisionMetadata(nil, requested))
+	require.Empty(t, resolvedRevisionMetadata(nil, buildv1alpha1.SourceConfig{Blob: &buildv1alpha1.Blob{URL: "https://example.com/app.tgz"}}))
+}
+
+func TestBuildPodMetadata(t *testing.T) {
+	build := testBuild(1, "registry/app@sha256:1", "abc")
+	for _, entry := range buildMetadata(&build) {
+		require.NotEqual(t, "buildPod", entry.Name)
+	}
+
+	build.Status.PodName = "app-build-1-abcde-build-pod"
+	require.Contains(t, buildMetadata(&build), oc.NameVal{Name: "buildPod", Value: "app-build-1-abcde-build-pod"})
+}
+
+func TestBuildCached(t *testing.T) {
+	build := testBuild(2, "registry/app@sha256:2", "abc")
+	require.Contains(t, buildMetadata(&build), oc.NameVal{Name: "cached", Value: "false"}, "no cache volume")
+
+	build.Spec.CacheName = "app-cache"
+	require.Contains(t, buildMetadata(&build), oc.NameVal{Name: "cached", Value: "false"}, "first build")
+
+	build.Spec.LastBuild.Image = "registry/app@sha256:1"
+	_, known := buildCached(&build)
+	require.False(t, known, "restore has not completed")
+
+	build.Status.StepsCompleted = []string{"prepare", "detect", "restore"}
+	require.Contains(t, buildMetadata(&build), oc.NameVal{Name: "cached", Value: "true"})
+}
+
+func TestBuildpacksMetadata(t *testing.T) {
+	build := testBuild(1, "registry/app@sha256:1", "abc")
+	for _, entry := range buildMetadata(&build) {
+		require.NotEqual(t, "buildpacks", entry.Name)
+	}
+
+	build.Status.BuildMetadata = buildv1alpha1.BuildpackMetadataList{
+		{ID: "org.cloudfoundry.openjdk", Version: "1.0.0"},
+		{ID: "org.cloudfoundry.buildsystem", Version: "1.2.3"},
+	}
+	require.Contains(t, buildMetadata(&build), oc.NameVal{
+		Name:  "buildpacks",
+		Value: "org.cloudfoundry.openjdk@1.0.0,org.cloudfoundry.buildsystem@1.2.3",
+	})
+}
+
+func TestImageRepositoryMetadata(t *testing.T) {
+	image := testImage()
+	require.Equal(t, oc.Metadata{{Name: "imageRepository", Value: "registry/app"}}, imageRepositoryMetadata(image))
+	require.Contains(t, imageMetadata(image), oc.NameVal{Name: "imageRepository", Value: "registry/app"})
+
+	image.Spec.Tag = ""
+	require.Empty(t, imageRepositoryMetadata(image))
+}
+
+func TestRenameMetadata(t *testing.T) {
+	metadata := oc.Metadata{{Name: "tag", Value: "registry/app"}, {Name: "buildReason", Value: "COMMIT"}}
+	require.Equal(t, metadata, renameMetadata(metadata, nil))
+	require.Equal(t, oc.Metadata{{Name: "tag", Value: "registry/app"}, {Name: "reason", Value: "COMMIT"}},
+		renameMetadata(metadata, map[string]string{"buildReason": "reason", "unknown": "ignored"}))
+	require.Equal(t, "buildReason", metadata[1].Name, "the original is left alone")
+
+	_, err := parseSource(oc.Source{"image": "app", "metadata_keys": map[string]interface{}{"buildReason": ""}})
+	require.EqualError(t, err, `source field "metadata_keys.buildReason" must not be empty`)
+}
+
+func TestBuilderStatusKinds(t *testing.T) {
+	c := newFakeImageClient()
+	clusterBuilder := &buildv1alpha1.ClusterBuilder{}
+	clusterBuilder.Name = "default"
+	clusterBuilder.Status.RunImage = "registry/cluster-run@sha256:1"
+	c.clusterBuilders["default"] = clusterBuilder
+	builder := &buildv1alpha1.Builder{}
+	builder.Name, builder.Namespace = "default", "default"
+	builder.Status.RunImage = "registry/run@sha256:1"
+	c.builders[objectKey("default", "default")] = builder
+
+	image := testImage()
+	status, err := builderStatus(c, image)
+	require.NoError(t, err)
+	require.Equal(t, "registry/cluster-run@sha256:1", status.RunImage)
+
+	// A builder without a kind is namespaced, as kpack defaults it.
+	for _, kind := range []string{"Builder", ""} {
+		image.Spec.Builder.Kind = kind
+		status, err = builderStatus(c, image)
+		require.NoError(t, err, kind)
+		require.Equal(t, "registry/run@sha256:1", status.RunImage, kind)
+	}
+
+	image.Spec.Builder.Kind = "CustomBuilder"
+	_, err = builderStatus(c, image)
+	require.EqualError(t, err, `image app has unknown builder kind "CustomBuilder", expected "Builder" or "ClusterBuilder"`)
+}
+
+func TestImageGenerationMetadata(t *testing.T) {
+	image := testImage()
+	image.Generation = 3
+	require.Equal(t, oc.Metadata{{Name: "imageGeneration", Value: "3"}}, imageGenerationMetadata(image))
+	require.Contains(t, imageMetadata(image), oc.NameVal{Name: "imageGeneration", Value: "3"})
+
+	image.Generation = 0
+	require.Empty(t, imageGenerationMetadata(image))
+}
@@ -0,0 +1,69 @@
+package resource
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/pkg/errors"
+	"net/http"
+)
+
+// registryOptions configures registry access with the credentials in config, falling back to
+// anonymous access, and trusts `registry_ca_cert` in addition to the system's CAs. The
+// credentials must never be logged.
+func registryOptions(config *Config) ([]remote.Option, error) {
+	var options []remote.Option
+	if config.RegistryUsername == "" {
+		options = append(options, remote.WithAuth(authn.Anonymous))
+	} else {
+		options = append(options, remote.WithAuth(&authn.Basic{
+			Username: config.RegistryUsername,
+			Password: config.RegistryPassword,
+		}))
+	}
+
+	if config.RegistryCACert != "" {
+		transport, err := registryTransport(config.RegistryCACert)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, remote.WithTransport(transport))
+	}
+	return options, nil
+}
+
+// registryTransport is the default transport with caCert appended to the system's CA pool.
+func registryTransport(caCert string) (*http.Transport, error) {
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load the system CA pool")
+	}
+	if !pool.AppendCertsFromPEM([]byte(caCert)) {
+		return nil, errors.New(`source field "registry_ca_cert" must contain a PEM encoded certificate`)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	return transport, nil
+}
+
+// resolveDigest looks up the digest an image reference currently points to in its registry.
+func resolveDigest(ref string, options ...remote.Option) (string, error) {
+	reference, err := name.ParseReference(ref)
+	if err != nil {
+		return "", err
+	}
+
+	image, err := remote.Image(reference, options...)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to fetch %s", ref)
+	}
+
+	digest, err := image.Digest()
+	if err != nil {
+		return "", err
+	}
+	return digest.String(), nil
+}
@@ -0,0 +1,32 @@
+package resource
+
+import (
+	"encoding/pem"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRegistryTransportTrustsCACert(t *testing.T) {
+	registry := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer registry.Close()
+	caCert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: registry.Certificate().Raw})
+
+	_, err := (&http.Client{Transport: http.DefaultTransport}).Get(registry.URL)
+	require.Error(t, err)
+
+	transport, err := registryTransport(string(caCert))
+	require.NoError(t, err)
+	resp, err := (&http.Client{Transport: transport}).Get(registry.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	_, err = registryTransport("not a certificate")
+	require.EqualError(t, err, `source field "registry_ca_cert" must contain a PEM encoded certificate`)
+
+	options, err := registryOptions(&Config{RegistryCACert: string(caCert)})
+	require.NoError(t, err)
+	require.Len(t, options, 2)
+}
@@ -4,22 +4,35 @@ package resource
 import (
 	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
 	oc "github.com/cloudboss/ofcourse/ofcourse"
-	"github.com/pivotal/kpack/pkg/client/clientset/versioned"
-	"github.com/pivotal/kpack/pkg/logs"
+	buildv1alpha1 "github.com/pivotal/kpack/pkg/apis/build/v1alpha1"
+	"github.com/pkg/errors"
 	"io/ioutil"
-	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/client-go/kubernetes"
-	_ "k8s.io/client-go/plugin/pkg/client/auth"
-	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/util/yaml"
 	"knative.dev/pkg/apis/duck/v1alpha1"
+	"net"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 )
 
+// Version is the release of the resource, set when it is built with
+// -ldflags "-X github.com/matthewmcnew/kpack-resource/resource.Version=<version>".
+var Version = "dev"
+
+// VersionRequested reports whether a resource command was run with -version, in which case it
+// should print Version instead of speaking the Concourse protocol.
+func VersionRequested(args []string) bool {
+	return len(args) == 1 && (args[0] == "-version" || args[0] == "--version")
+}
+
 // This resource is only a skeleton for getting started. What it does:
 //
 // For `Check`, it increments its version each time it is called, starting with `{"count": "1"}`. The
@@ -43,10 +56,16 @@ import (
 // pipelines, it will put a lot of load on the database's CPU.
 
 var (
-	// ErrVersion means version map is malformed
-	ErrVersion = errors.New(`key "count" not found in version map`)
 	// ErrParam means parameters are malformed
 	ErrParam = errors.New(`missing "version_path" parameter`)
+	// ErrMissingKubeconfig means the kubeconfig source field is malformed
+	ErrMissingKubeconfig = errors.New(`source field "kubeconfig" must be a string`)
+	// ErrMissingNamespace means the namespace source field is malformed
+	ErrMissingNamespace = errors.New(`source field "namespace" must be a string`)
+	// ErrAllNamespaces means a put was configured to search every namespace
+	ErrAllNamespaces = errors.New(`source field "all_namespaces" cannot be used by put`)
+	// ErrMissingImage means the image source field is missing or malformed
+	ErrMissingImage = errors.New(`source field "image" is required and must be a string`)
 )
 
 // Resource implements the ofcourse.Resource interface.
@@ -54,77 +73,111 @@ type Resource struct{}
 
 // Check implements the ofcourse.Resource Check method, corresponding to the /opt/resource/check command.
 // This is called when Concourse does its resource checks, or when the `fly check-resource` command is run.
+//
+// When version is nil exactly one version, the latest result, is returned so the resource has a
+// starting point. An empty list is only returned then if the image has never built successfully.
 func (r *Resource) Check(source oc.Source, version oc.Version, env oc.Environment,
-	logger *oc.Logger) ([]oc.Version, error) {
-
-	var oldVersion string
-	if version != nil {
-		var ok bool
-		oldVersion, ok = version["ref"]
-		if !ok {
-			return nil, ErrVersion
-		}
-	}
-
-	k, ok := source["kubeconfig"].(string)
-	if !ok {
-		logger.Errorf("not a string")
-		return nil, errors.New("blah")
-	}
+	ocLogger *oc.Logger) ([]oc.Version, error) {
 
-	f, err := ioutil.TempFile("", "kube")
+	config, err := parseSource(source)
 	if err != nil {
-		logger.Errorf(err.Error())
+		ocLogger.Errorf(err.Error())
 		return nil, err
 	}
+	logger := newLogger(ocLogger, config)
 
-	f.WriteString(k)
-	if err != nil {
-		logger.Errorf(err.Error())
-		return nil, err
+	if version != nil {
+		key := trackedKey(config.Track)
+		if _, ok := version[key]; !ok {
+			return nil, errors.Errorf(`key "%s" not found in version map`, key)
+		}
 	}
 
-	err = f.Close()
+	// Every request is bounded so a slow or unreachable API server cannot hold up the checker.
+	client, _, err := connect(logger, config, config.CheckTimeout)
 	if err != nil {
 		logger.Errorf(err.Error())
 		return nil, err
 	}
 
-	clusterConfig, err := clientcmd.BuildConfigFromFlags("", f.Name())
-	if err != nil {
-		logger.Errorf(err.Error())
-		return nil, err
+	if len(config.Images) > 0 {
+		return checkImages(client, config, version, logger)
 	}
 
-	clientset, err := versioned.NewForConfig(clusterConfig)
+	image, err := selectImage(client, config)
+	if k8serrors.IsNotFound(err) {
+		err = imageNotFound(config, config.Image)
+		if !config.RequireImage {
+			logger.Warnf(err.Error())
+			return []oc.Version{}, nil
+		}
+	}
+	if err == nil {
+		err = checkNotDeleting(image)
+	}
 	if err != nil {
+		err = requestError(err, config.CheckTimeout)
 		logger.Errorf(err.Error())
 		return nil, err
 	}
-
-	namespace, ok := source["namespace"].(string)
-	if !ok {
-		logger.Errorf("namespace not a string")
-		return nil, errors.New("blah")
+	if config.Debug {
+		debugImageStatus(image, logger)
 	}
 
-	imageName, ok := source["image"].(string)
-	if !ok {
-		logger.Errorf("namespace not a string")
-		return nil, errors.New("namespace not a string")
+	if config.Track == trackSourceResolver {
+		return checkSourceResolver(client, image, version, config, logger)
 	}
-	image, err := clientset.BuildV1alpha1().Images(namespace).Get(imageName, v1.GetOptions{})
+
+	history, err := listBuilds(client, config.buildNamespace(image.Namespace), image.Name, config.PageSize)
 	if err != nil {
-		return nil, err
+		return nil, requestError(err, config.CheckTimeout)
 	}
+	builds := filterBuilds(history, config)
 
-	if image.Status.GetCondition(v1alpha1.ConditionReady).IsTrue() && image.Status.LatestImage != oldVersion {
-		versions := []oc.Version{{
-			"ref":   image.Status.LatestImage,
-			"build": image.Status.LatestBuildRef,
-		}}
+	if versions := versionsSince(builds, version, config); len(versions) > 0 {
 		return versions, nil
 	}
+	// Without a version Concourse needs a starting point, and a settled image is one even when the
+	// build that produced it has been pruned from the history. A build the filters leave out of the
+	// history is not one.
+	if version == nil && config.Track == trackImage && imageSettled(image, history, config.ReadyCondition) &&
+		matchesSubPath(image.Spec.Source, config.SourceSubPath) {
+		latest := -1
+		for i := range history {
+			if history[i].Name == image.Status.LatestBuildRef {
+				latest = i
+			}
+		}
+		switch {
+		case latest < 0:
+			return []oc.Version{imageVersion(image)}, nil
+		case matchesFilters(&history[latest], config):
+			return []oc.Version{trackedVersion(&history[latest], config.Track)}, nil
+		default:
+			logger.Infof("latest build %s of image %s is filtered out", history[latest].Name, image.Name)
+		}
+	} else {
+		explainNoVersions(image, config.ReadyCondition, logger)
+	}
+
+	if config.Watch {
+		ctx, stop := withSignals(context.Background())
+		defer stop()
+		ctx, cancel := context.WithTimeout(ctx, config.CheckTimeout)
+		defer cancel()
+
+		rebuilt, err := watchImage(ctx, client, image, config.ReadyCondition, logger)
+		if err != nil || !rebuilt {
+			return []oc.Version{}, err
+		}
+
+		builds, err := listBuilds(client, config.buildNamespace(image.Namespace), image.Name, config.PageSize)
+		if err != nil {
+			return nil, requestError(err, config.CheckTimeout)
+		}
+		builds = filterBuilds(builds, config)
+		return versionsSince(builds, version, config), nil
+	}
 
 	// Returned `versions` should be all of the versions since the one given in the `version`
 	// argument. If `version` is nil, then return the first available version. In many cases there
@@ -153,85 +206,305 @@ func (r *Resource) Check(source oc.Source, version oc.Version, env oc.Environmen
 
 }
 
+// selectImage finds the image named in config or, alternatively, the single image matching its
+// label selector. Without a namespace, images in every namespace are considered. When nothing
+// matches, the error is a NotFound, as it is for a named image in a namespace.
+func selectImage(client ImageClient, config *Config) (*buildv1alpha1.Image, error) {
+	if config.Image != "" && config.Namespace != "" {
+		return client.GetImage(config.Namespace, config.Image)
+	}
+
+	listOptions := v1.ListOptions{LabelSelector: config.LabelSelector}
+	description := fmt.Sprintf(`label_selector "%s"`, config.LabelSelector)
+	if config.Image != "" {
+		listOptions = v1.ListOptions{FieldSelector: fields.OneTermEqualSelector("metadata.name", config.Image).String()}
+		description = fmt.Sprintf(`image name "%s"`, config.Image)
+	}
+
+	images, err := client.ListImages(config.Namespace, listOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(images.Items) == 0 {
+		return nil, k8serrors.NewNotFound(buildv1alpha1.Resource("images"), config.Image)
+	}
+	if len(images.Items) != 1 {
+		return nil, errors.Errorf("%s matched %d images in %s, expected exactly 1", description, len(images.Items),
+			imageScope(config))
+	}
+	return &images.Items[0], nil
+}
+
+// imageScope describes the namespaces config looks for images in.
+func imageScope(config *Config) string {
+	if config.Namespace == "" {
+		return "all namespaces"
+	}
+	return "namespace " + config.Namespace
+}
+
+// imageNotFound is the error for a Check that found no image named name or, without a name,
+// matching the label selector.
+func imageNotFound(config *Config, name string) error {
+	if name == "" {
+		return errors.Errorf(`no image matching label_selector "%s" found in %s`, config.LabelSelector, imageScope(config))
+	}
+	return errors.Errorf("image %s not found in %s", name, imageScope(config))
+}
+
+// checkImages reports the builds of every image in config.Images as one stream of versions, each
+// naming the image it belongs to.
+func checkImages(client ImageClient, config *Config, version oc.Version, logger *Logger) ([]oc.Version, error) {
+	var builds []buildv1alpha1.Build
+	for _, name := range config.Images {
+		named := *config
+		named.Image, named.Images = name, nil
+
+		image, err := selectImage(client, &named)
+		if k8serrors.IsNotFound(err) {
+			err = imageNotFound(config, name)
+			if !config.RequireImage {
+				logger.Warnf(err.Error())
+				continue
+			}
+		}
+		if err == nil {
+			err = checkNotDeleting(image)
+		}
+		if err != nil {
+			err = requestError(err, config.CheckTimeout)
+			logger.Errorf(err.Error())
+			return nil, err
+		}
+		if config.Debug {
+			debugImageStatus(image, logger)
+		}
+
+		imageBuilds, err := listBuilds(client, config.buildNamespace(image.Namespace), image.Name, config.PageSize)
+		if err != nil {
+			return nil, requestError(err, config.CheckTimeout)
+		}
+		builds = append(builds, filterBuilds(imageBuilds, config)...)
+	}
+	sortByCreation(builds)
+
+	versions := versionsSince(builds, version, config)
+	if len(versions) == 0 {
+		logger.Infof("no new builds of images %s", strings.Join(config.Images, ", "))
+	}
+	return versions, nil
+}
+
+// debugImageStatus logs the full status Check saw for an image, to help explain why it did or did
+// not return a version.
+func debugImageStatus(image *buildv1alpha1.Image, logger *Logger) {
+	status, err := json.MarshalIndent(image.Status, "", "  ")
+	if err != nil {
+		logger.Debugf("could not encode the status of image %s: %s", image.Name, err)
+		return
+	}
+	logger.Debugf("status of image %s in namespace %s:\n%s", image.Name, image.Namespace, status)
+}
+
+// checkSourceResolver reports the git revision kpack's SourceResolver for image resolved its source
+// to, which changes as soon as the revision does rather than once a build of it has finished.
+func checkSourceResolver(client ImageClient, image *buildv1alpha1.Image, version oc.Version, config *Config,
+	logger *Logger) ([]oc.Version, error) {
+
+	resolver, err := client.GetSourceResolver(image.Namespace, image.SourceResolverName())
+	if err != nil {
+		err = requestError(err, config.CheckTimeout)
+		logger.Errorf(err.Error())
+		return nil, err
+	}
+
+	git := resolver.Status.Source.Git
+	if git == nil || git.Revision == "" {
+		logger.Infof("source of image %s has not been resolved to a git revision", image.Name)
+		return []oc.Version{}, nil
+	}
+	if version != nil && version["revision"] == git.Revision {
+		return []oc.Version{}, nil
+	}
+	return []oc.Version{{"revision": git.Revision}}, nil
+}
+
+// explainNoVersions logs why Check found nothing new: the image has not built yet, or its latest
+// build failed.
+func explainNoVersions(image *buildv1alpha1.Image, readyCondition string, logger *Logger) {
+	ready, reason, message := imageReadiness(image, readyCondition)
+	switch {
+	case imageFailed(image, readyCondition):
+		logger.Warnf("latest build of image %s failed: %s %s", image.Name, reason, message)
+	case image.Status.LatestImage == "":
+		logger.Infof("image %s has not been built yet", image.Name)
+	case !ready:
+		logger.Infof("image %s is building", image.Name)
+	}
+}
+
+// watchImage blocks until image is ready with a different LatestImage, reporting whether that
+// happened before ctx timed out. A cancelled ctx is returned as an error.
+func watchImage(ctx context.Context, client ImageClient, image *buildv1alpha1.Image, readyCondition string,
+	logger *Logger) (bool, error) {
+
+	w, err := client.WatchImages(image.Namespace, v1.ListOptions{
+		FieldSelector:   fields.OneTermEqualSelector("metadata.name", image.Name).String(),
+		ResourceVersion: image.ResourceVersion,
+	})
+	if err != nil {
+		return false, err
+	}
+	defer w.Stop()
+
+	logger.Debugf("watching image %s", image.Name)
+	for {
+		select {
+		case <-ctx.Done():
+			if ctx.Err() == context.DeadlineExceeded {
+				return false, nil
+			}
+			return false, errors.Wrap(ctx.Err(), "check cancelled")
+		case event, ok := <-w.ResultChan():
+			if !ok {
+				return false, nil
+			}
+
+			updated, ok := event.Object.(*buildv1alpha1.Image)
+			if !ok {
+				continue
+			}
+
+			if ready, _, _ := imageReadiness(updated, readyCondition); ready && !sameImage(updated.Status.LatestImage, image.Status.LatestImage) {
+				return true, nil
+			}
+		}
+	}
+}
+
 // In implements the ofcourse.Resource In method, corresponding to the /opt/resource/in command.
 // This is called when a Concourse job does `get` on the resource.
 func (r *Resource) In(outputDirectory string, source oc.Source, params oc.Params, version oc.Version,
-	env oc.Environment, logger *oc.Logger) (oc.Version, oc.Metadata, error) {
+	env oc.Environment, ocLogger *oc.Logger) (oc.Version, oc.Metadata, error) {
 	// Demo of logging. Resources should never use fmt.Printf or anything that writes
 	// to standard output, as it will corrupt the JSON output expected by Concourse.
 
+	config, err := parseSource(source)
+	if err != nil {
+		ocLogger.Errorf(err.Error())
+		return nil, nil, err
+	}
+	logger := newLogger(ocLogger, config)
+
+	inParams, err := parseInParams(params)
+	if err != nil {
+		logger.Errorf(err.Error())
+		return nil, nil, err
+	}
+
 	// Write the `version` argument to a file in the output directory,
 	// so the `Out` function can read it.
-	outputPath := fmt.Sprintf("%s/version", outputDirectory)
 	bytes, err := json.Marshal(version)
 	if err != nil {
 		return nil, nil, err
 	}
 	logger.Debugf("Version: %s", string(bytes))
 
-	err = ioutil.WriteFile(outputPath, bytes, 0644)
-	if err != nil {
-		return nil, nil, err
+	if inParams.WriteFiles {
+		err = ioutil.WriteFile(fmt.Sprintf("%s/version", outputDirectory), bytes, 0644)
+		if err != nil {
+			return nil, nil, err
+		}
 	}
 
-	k, ok := source["kubeconfig"].(string)
-	if !ok {
-		logger.Errorf("not a string")
-		return nil, nil, errors.New("blah")
+	tag, digest := splitImageRef(version["ref"])
+	if digest == "" && tag != "" {
+		options, err := registryOptions(config)
+		if err == nil {
+			digest, err = resolveDigest(tag, options...)
+		}
+		if err != nil {
+			logger.Warnf("could not resolve digest for %s: %s", tag, err)
+		}
 	}
 
-	f, err := ioutil.TempFile("", "kube")
-	if err != nil {
-		logger.Errorf(err.Error())
-		return nil, nil, err
+	// Plain-text copies of the image reference let tasks use it without parsing JSON.
+	if inParams.WriteFiles {
+		for name, contents := range map[string]string{
+			"image":  version["ref"],
+			"digest": digest,
+			"tag":    tag,
+		} {
+			err = ioutil.WriteFile(fmt.Sprintf("%s/%s", outputDirectory, name), []byte(contents), 0644)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
 	}
 
-	f.WriteString(k)
+	client, k8sClient, err := connect(logger, config, 0)
 	if err != nil {
 		logger.Errorf(err.Error())
 		return nil, nil, err
 	}
 
-	err = f.Close()
-	if err != nil {
-		logger.Errorf(err.Error())
-		return nil, nil, err
+	// kpack prunes old builds, so a version may outlive the build that produced it.
+	if version["build"] == "" {
+		logger.Warnf("version has no build reference, skipping build metadata")
+		return version, oc.Metadata{}, writeMetadata(outputDirectory, oc.Metadata{}, inParams)
 	}
 
-	clusterConfig, err := clientcmd.BuildConfigFromFlags("", f.Name())
-	if err != nil {
-		logger.Errorf(err.Error())
+	build, err := getBuild(client, config.buildNamespace(config.Namespace), version["build"])
+	if k8serrors.IsNotFound(err) {
+		logger.Warnf("build %s no longer exists, skipping build metadata", version["build"])
+		return version, oc.Metadata{}, writeMetadata(outputDirectory, oc.Metadata{}, inParams)
+	} else if err != nil {
 		return nil, nil, err
 	}
-
-	clientset, err := versioned.NewForConfig(clusterConfig)
-	if err != nil {
+	// Versions from a resource tracking several images name the image their build belongs to.
+	if image := version["image"]; image != "" && build.Labels[buildv1alpha1.ImageLabel] != image {
+		err := errors.Errorf("build %s does not belong to image %s", build.Name, image)
 		logger.Errorf(err.Error())
 		return nil, nil, err
 	}
 
-	namespace, ok := source["namespace"].(string)
-	if !ok {
-		logger.Errorf("namespace not a string")
-		return nil, nil, errors.New("blah")
+	// Metadata consists of arbitrary name/value pairs for display in the Concourse UI,
+	// and may be returned empty if not needed.
+	metadata := sourceMetadata(build.Spec.Source)
+	metadata = append(metadata, imageRefMetadata(tag, digest)...)
+	metadata = append(metadata, buildMetadata(build)...)
+	metadata = append(metadata, resolvedRevisionMetadata(build, build.Spec.Source)...)
+
+	if inParams.SaveLogs {
+		err = saveBuildLogs(k8sClient, build, fmt.Sprintf("%s/build.log", outputDirectory))
+		if err != nil {
+			logger.Warnf("could not save the logs of build %s: %s", build.Name, err)
+		}
 	}
 
-	build, err := clientset.BuildV1alpha1().Builds(namespace).Get(version["build"], v1.GetOptions{})
+	// With `build_namespace` the build may live apart from its image.
+	imageNamespace := build.Namespace
+	if config.Namespace != "" {
+		imageNamespace = config.Namespace
+	}
+	image, err := client.GetImage(imageNamespace, build.Labels[buildv1alpha1.ImageLabel])
 	if err != nil {
-		return nil, nil, err
+		logger.Warnf("could not read the image for build %s: %s", build.Name, err)
+	} else {
+		metadata = append(metadata, imageRepositoryMetadata(image)...)
+		metadata = append(metadata, imageGenerationMetadata(image)...)
+		builder, err := builderMetadata(client, image)
+		if err != nil {
+			logger.Warnf("could not read builder %s: %s", image.Spec.Builder.Name, err)
+		}
+		metadata = append(metadata, builder...)
+		metadata = append(metadata, buildCountMetadata(build, image)...)
 	}
 
-	// Metadata consists of arbitrary name/value pairs for display in the Concourse UI,
-	// and may be returned empty if not needed.
-	metadata := oc.Metadata{
-		{
-			Name:  "gitUrl",
-			Value: build.Spec.Source.Git.URL,
-		},
-		{
-			Name:  "gitRevision",
-			Value: build.Spec.Source.Git.Revision,
-		},
+	metadata = renameMetadata(metadata, config.MetadataKeys)
+	if err := writeMetadata(outputDirectory, metadata, inParams); err != nil {
+		return nil, nil, err
 	}
 
 	// Here, `version` is passed through from the argument. In most cases, it makes sense
@@ -241,21 +514,49 @@ func (r *Resource) In(outputDirectory string, source oc.Source, params oc.Params
 	return version, metadata, nil
 }
 
-type logInfoWriter struct {
-	logger *oc.Logger
+// writeMetadata saves the metadata In returns as metadata.json in its output directory, in the same
+// order Concourse receives it, so tasks can read it without querying the cluster. Nothing is written
+// when the get disabled `write_files`.
+func writeMetadata(outputDirectory string, metadata oc.Metadata, inParams *InParams) error {
+	if !inParams.WriteFiles {
+		return nil
+	}
+
+	bytes, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fmt.Sprintf("%s/metadata.json", outputDirectory), bytes, 0644)
 }
 
-func (l logInfoWriter) Write(p []byte) (n int, err error) {
-	s := string(p)
+// getBuild fetches the named build. Without a namespace, the build is looked up in every namespace,
+// matching how Check discovers images.
+func getBuild(client ImageClient, namespace, name string) (*buildv1alpha1.Build, error) {
+	if namespace != "" {
+		return client.GetBuild(namespace, name)
+	}
+
+	builds, err := client.ListBuilds("", v1.ListOptions{
+		FieldSelector: fields.OneTermEqualSelector("metadata.name", name).String(),
+	})
+	if err != nil {
+		return nil, err
+	}
 
-	l.logger.Infof(strings.TrimSuffix(s, "\n"))
-	return len(s), nil
+	switch len(builds.Items) {
+	case 0:
+		return nil, k8serrors.NewNotFound(buildv1alpha1.SchemeGroupVersion.WithResource("builds").GroupResource(), name)
+	case 1:
+		return &builds.Items[0], nil
+	default:
+		return nil, errors.Errorf("build %s exists in %d namespaces, set the namespace source field", name, len(builds.Items))
+	}
 }
 
 // Out implements the ofcourse.Resource Out method, corresponding to the /opt/resource/out command.
 // This is called when a Concourse job does a `put` on the resource.
 func (r *Resource) Out(inputDirectory string, source oc.Source, params oc.Params,
-	env oc.Environment, logger *oc.Logger) (oc.Version, oc.Metadata, error) {
+	env oc.Environment, ocLogger *oc.Logger) (oc.Version, oc.Metadata, error) {
 	//// The `Out` function does not receive a `version` argument. Instead, we
 	//// will read the version from the file created by the `In` function, assuming
 	//// the pipeline does a `get` of this resource. The path to the version file
@@ -280,127 +581,491 @@ func (r *Resource) Out(inputDirectory string, source oc.Source, params oc.Params
 	//	return nil, nil, err
 	//}
 
-	clientset, k8sclient, err := getKubeconfig(logger, source)
+	config, err := parseSource(source)
 	if err != nil {
-		logger.Errorf(err.Error())
+		ocLogger.Errorf(err.Error())
 		return nil, nil, err
 	}
+	logger := newLogger(ocLogger, config)
 
-	namespace, ok := source["namespace"].(string)
-	if !ok {
-		logger.Errorf("namespace not a string")
-		return nil, nil, errors.New("blah")
+	// A put triggers one specific image, so a label selector or cluster-wide lookup is not enough.
+	if config.Image == "" {
+		logger.Errorf(ErrMissingImage.Error())
+		return nil, nil, ErrMissingImage
 	}
-	logger.Debugf("namespace %s", namespace)
-
-	imageName, ok := source["image"].(string)
-	if !ok {
-		logger.Errorf("namespace not a string")
-		return nil, nil, errors.New("blah")
+	if config.AllNamespaces {
+		logger.Errorf(ErrAllNamespaces.Error())
+		return nil, nil, ErrAllNamespaces
 	}
-	logger.Debugf("image %s", imageName)
 
-	image, err := clientset.BuildV1alpha1().Images(namespace).Get(imageName, v1.GetOptions{})
+	client, k8sclient, err := connect(logger, config, 0)
 	if err != nil {
 		logger.Errorf(err.Error())
 		return nil, nil, err
 	}
-	logger.Debugf("found: image with name: %s", image.Name)
 
-	image = image.DeepCopy()
-	image.Spec.Build.Env = append(image.Spec.Build.Env, corev1.EnvVar{
-		Name:      "buildkicker",
-		Value:     fmt.Sprintf("%d", time.Now().Nanosecond()),
-		ValueFrom: nil,
-	})
-	nextBuildNumber := image.Status.BuildCounter + 1
+	namespace, imageName := config.Namespace, config.Image
+	buildNamespace := config.buildNamespace(namespace)
+	logger.Debugf("namespace %s", namespace)
+	logger.Debugf("image %s", imageName)
 
-	_, err = clientset.BuildV1alpha1().Images(namespace).Update(image)
+	outParams, err := parseOutParams(params)
 	if err != nil {
 		logger.Errorf(err.Error())
 		return nil, nil, err
 	}
 
-	go func() {
-		err = logs.NewBuildLogsClient(k8sclient).Tail(context.Background(), logInfoWriter{logger}, imageName, fmt.Sprintf("%d", nextBuildNumber), namespace)
+	// buildNumber is the build to follow. It stays zero when the build has yet to be started by kpack.
+	var previousBuildCounter, buildNumber int64
+	started := time.Now()
+	image, err := client.GetImage(namespace, imageName)
+	if err == nil {
+		err = checkNotDeleting(image)
+	}
+	// previous is the image as it was before the put, to tell whether the build changed it. It is nil
+	// when the put creates the image; the typed client returns an empty image along with NotFound.
+	var previous *buildv1alpha1.Image
+	if err == nil {
+		previous = image
+	}
+	if outParams.Mode == outModeBuild {
+		// The image is only read from, so the revision and builder apply to the one-off build alone.
+		if err == nil {
+			image = image.DeepCopy()
+			err = setSourceRevision(image, outParams.SourceRevision)
+		}
+		if err == nil {
+			err = setBuilder(client, image, outParams.BuilderKind, outParams.BuilderName)
+		}
+		if err != nil {
+			logger.Errorf(err.Error())
+			return nil, nil, err
+		}
+		return runStandaloneBuild(config, outParams, client, k8sclient, image, logger)
+	}
+	if k8serrors.IsNotFound(err) && outParams.CreateIfMissing != "" {
+		image, err = readImageManifest(fmt.Sprintf("%s/%s", inputDirectory, outParams.CreateIfMissing), namespace, imageName)
 		if err != nil {
 			logger.Errorf(err.Error())
+			return nil, nil, err
 		}
-	}()
 
-	for {
-		time.Sleep(10 * time.Second)
-		image, err = clientset.BuildV1alpha1().Images(namespace).Get(imageName, v1.GetOptions{})
+		if outParams.DryRun {
+			logger.Infof("dry run: would create image %s in namespace %s", imageName, namespace)
+			return oc.Version{}, oc.Metadata{}, nil
+		}
+
+		// A new image builds on its own, so there is nothing to trigger.
+		_, err = client.CreateImage(image)
 		if err != nil {
 			logger.Errorf(err.Error())
 			return nil, nil, err
 		}
+		logger.Infof("created image %s", imageName)
+	} else if err != nil {
+		logger.Errorf(err.Error())
+		return nil, nil, err
+	} else if outParams.SkipIfBuilding && !outParams.DryRun && isBuilding(image, config.ReadyCondition) {
+		logger.Infof("build %d of image %s is already running, waiting for it instead of triggering another",
+			image.Status.BuildCounter, imageName)
+		if len(outParams.Env) > 0 {
+			logger.Warnf("env is not applied to a build that is already running")
+		}
+		if outParams.SourceRevision != "" {
+			logger.Warnf("source_revision is not applied to a build that is already running")
+		}
+		if outParams.BuilderName != "" {
+			logger.Warnf("builder_name is not applied to a build that is already running")
+		}
+		buildNumber = image.Status.BuildCounter
+	} else {
+		logger.Debugf("found: image with name: %s", image.Name)
+
+		if outParams.DryRun {
+			logger.Infof("dry run: would trigger build %d of image %s in namespace %s",
+				image.Status.BuildCounter+1, imageName, namespace)
+
+			version := latestVersion(client, buildNamespace, image, config.Track)
+			return version, renameMetadata(imageMetadata(image), config.MetadataKeys), nil
+		}
+
+		triggered := image.DeepCopy()
+		if triggered.Annotations == nil {
+			triggered.Annotations = map[string]string{}
+		}
+		if err := applyPutEnv(triggered, outParams.Env); err != nil {
+			logger.Errorf(err.Error())
+			return nil, nil, err
+		}
+		setTrigger(triggered, config.TriggerAnnotation, time.Now())
+		if err := setSourceRevision(triggered, outParams.SourceRevision); err != nil {
+			logger.Errorf(err.Error())
+			return nil, nil, err
+		}
+		if err := setBuilder(client, triggered, outParams.BuilderKind, outParams.BuilderName); err != nil {
+			logger.Errorf(err.Error())
+			return nil, nil, err
+		}
+		previousBuildCounter = image.Status.BuildCounter
 
-		if image.Status.GetCondition(v1alpha1.ConditionReady).IsTrue() {
-			metadata := oc.Metadata{
-				{
-					Name:  "gitUrl",
-					Value: image.Spec.Source.Git.URL,
-				},
-				{
-					Name:  "gitRevision",
-					Value: image.Spec.Source.Git.Revision,
-				},
-			}
+		patch, err := triggerPatch(image, triggered, config.TriggerAnnotation)
+		if err != nil {
+			logger.Errorf(err.Error())
+			return nil, nil, err
+		}
+		_, err = client.PatchImage(namespace, imageName, patch)
+		if err != nil {
+			logger.Errorf(err.Error())
+			return nil, nil, err
+		}
+	}
 
-			return oc.Version{
-				"ref":   image.Status.LatestImage,
-				"build": image.Status.LatestBuildRef,
-			}, metadata, nil
+	ctx, stop := withSignals(context.Background())
+	defer stop()
+	ctx, cancel := context.WithTimeout(ctx, config.BuildTimeout)
+	defer cancel()
+	poll := newPollBackoff(config.MinPollInterval, config.PollInterval)
+
+	// Follow the build kpack actually started rather than assuming the next number is ours.
+	if buildNumber == 0 {
+		buildNumber, err = waitForNewBuild(ctx, client, namespace, imageName, previousBuildCounter, poll, logger)
+		if err != nil {
+			err = waitError(err, config, fmt.Sprintf("a new build of image %s to start", imageName))
+			logger.Errorf(err.Error())
+			return nil, nil, err
+		}
+		if err := markPutTrigger(client, buildNamespace, imageName, buildNumber); err != nil {
+			logger.Warnf("could not mark build %d of image %s as triggered by this put: %s", buildNumber, imageName, err)
 		}
 	}
+	logger.Debugf("following build %d", buildNumber)
 
-	// Both `version` and `metadata` may be empty. In this case, we are returning
-}
+	// The returned version names the running build, and its image is left for a later get.
+	if outParams.Wait == waitStart {
+		build, err := getNumberedBuild(client, buildNamespace, imageName, buildNumber)
+		if err == nil && build == nil {
+			err = errors.Errorf("build %d of image %s does not exist", buildNumber, imageName)
+		}
+		if err != nil {
+			logger.Errorf(err.Error())
+			return nil, nil, err
+		}
+		logger.Infof("started build %d of image %s", buildNumber, imageName)
+		return buildVersion(build), renameMetadata(buildMetadata(build), config.MetadataKeys), nil
+	}
 
-func getKubeconfig(logger *oc.Logger, source oc.Source) (*versioned.Clientset, *kubernetes.Clientset, error) {
-	k, ok := source["kubeconfig"].(string)
-	if !ok {
-		logger.Errorf("not a string")
-		return nil, nil, errors.New("blah")
+	if streamsBuildLogs(config.LogLevel) {
+		tail := startLogTail(ctx, k8sclient, logger, config.LogLevel, imageName, fmt.Sprintf("%d", buildNumber), buildNamespace)
+		defer tail.stop(logDrainTimeout)
+	}
+	if outParams.ShowEvents {
+		events := startEventTail(ctx, client, k8sclient, logger, buildNamespace, imageName, buildNumber, started)
+		defer events.stop(0)
 	}
 
-	f, err := ioutil.TempFile("", "kube")
+	if config.ScheduleTimeout > 0 {
+		err = waitForScheduling(ctx, client, k8sclient, buildNamespace, imageName, buildNumber,
+			config.ScheduleTimeout, poll, logger)
+	}
+	if err == nil {
+		image, err = waitForImage(ctx, client, namespace, imageName, poll, logger, func(image *buildv1alpha1.Image) (bool, error) {
+			if image.Status.BuildCounter < buildNumber || image.Status.BuildCounter < outParams.MinBuildNumber {
+				return false, nil
+			}
+
+			ready, reason, message := imageReadiness(image, config.ReadyCondition)
+			if imageFailed(image, config.ReadyCondition) {
+				if reason == "" && message == "" {
+					return false, errors.Errorf("build %d of image %s failed", image.Status.BuildCounter, imageName)
+				}
+				return false, errors.Errorf("build %d of image %s failed: %s %s", image.Status.BuildCounter, imageName, reason, message)
+			}
+			return ready, nil
+		})
+	}
 	if err != nil {
+		if err == context.Canceled && outParams.CancelOnAbort {
+			if err := cancelBuild(client, buildNamespace, imageName, buildNumber); err != nil {
+				logger.Warnf("could not cancel build %d of image %s: %s", buildNumber, imageName, err)
+			} else {
+				logger.Infof("cancelled build %d of image %s", buildNumber, imageName)
+			}
+		}
+		err = waitError(err, config, fmt.Sprintf("build %d of image %s", buildNumber, imageName))
 		logger.Errorf(err.Error())
 		return nil, nil, err
 	}
 
-	f.WriteString(k)
-	if err != nil {
+	noop := previous != nil && previous.Status.LatestImage != "" &&
+		sameImage(image.Status.LatestImage, previous.Status.LatestImage)
+	if noop && outParams.FailOnNoop {
+		err := errors.Errorf("build %d of image %s produced the image it already had, %s",
+			buildNumber, imageName, image.Status.LatestImage)
 		logger.Errorf(err.Error())
 		return nil, nil, err
 	}
 
-	err = f.Close()
+	if len(outParams.OnSuccessAnnotations) > 0 {
+		image, err = annotateImage(client, image, outParams.OnSuccessAnnotations)
+		if err != nil {
+			err = errors.Wrapf(err, "build %d of image %s succeeded, but annotating the image failed", buildNumber, imageName)
+			logger.Errorf(err.Error())
+			return nil, nil, err
+		}
+	}
+
+	metadata := imageMetadata(image)
+
+	build, err := client.GetBuild(buildNamespace, image.Status.LatestBuildRef)
 	if err != nil {
-		logger.Errorf(err.Error())
-		return nil, nil, err
+		logger.Warnf("could not read build %s: %s", image.Status.LatestBuildRef, err)
+		build = nil
+	} else {
+		metadata = append(metadata, buildMetadata(build)...)
+		metadata = append(metadata, buildCountMetadata(build, image)...)
 	}
+	metadata = append(metadata, resolvedRevisionMetadata(build, image.Spec.Source)...)
 
-	clusterConfig, err := clientcmd.BuildConfigFromFlags("", f.Name())
+	builder, err := builderMetadata(client, image)
 	if err != nil {
-		logger.Errorf(err.Error())
-		return nil, nil, err
+		logger.Warnf("could not read builder %s: %s", image.Spec.Builder.Name, err)
 	}
+	metadata = append(metadata, builder...)
+	if previous != nil && (previous.Spec.Builder.Kind != image.Spec.Builder.Kind || previous.Spec.Builder.Name != image.Spec.Builder.Name) {
+		metadata = append(metadata, oc.NameVal{
+			Name:  "previousBuilder",
+			Value: fmt.Sprintf("%s/%s", previous.Spec.Builder.Kind, previous.Spec.Builder.Name),
+		})
+	}
+	metadata = append(metadata, requestedRevisionMetadata(outParams.SourceRevision)...)
 
-	clientset, err := versioned.NewForConfig(clusterConfig)
+	builds, err := listBuilds(client, buildNamespace, imageName, config.PageSize)
 	if err != nil {
-		logger.Errorf(err.Error())
-		return nil, nil, err
+		logger.Warnf("could not read the builds of image %s: %s", imageName, err)
+	} else {
+		metadata = append(metadata, previousImageMetadata(previousImage(builds, image.Status.LatestBuildRef))...)
+	}
+
+	// An unchanged image is reported as the version the put started from, so nothing downstream
+	// runs again for it.
+	if noop && outParams.SkipNoop {
+		logger.Infof("build %d of image %s did not change the image", buildNumber, imageName)
+		metadata = append(metadata, oc.NameVal{
+			Name:  "noop",
+			Value: "true",
+		})
+		version := latestVersion(client, buildNamespace, previous, config.Track)
+		return version, renameMetadata(metadata, config.MetadataKeys), nil
 	}
 
-	k8sClient, err := kubernetes.NewForConfig(clusterConfig)
+	if build == nil {
+		return imageVersion(image), renameMetadata(metadata, config.MetadataKeys), nil
+	}
+	return trackedVersion(build, config.Track), renameMetadata(metadata, config.MetadataKeys), nil
+}
+
+// annotateImage sets annotations on image with a merge patch, leaving its other annotations alone.
+func annotateImage(client ImageClient, image *buildv1alpha1.Image, annotations map[string]string) (*buildv1alpha1.Image, error) {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": annotations,
+		},
+	})
 	if err != nil {
-		logger.Errorf(err.Error())
-		return nil, nil, err
+		return nil, err
+	}
+	return client.PatchImage(image.Namespace, image.Name, patch)
+}
+
+// checkNotDeleting fails for an image that is being deleted, which kpack will never build again.
+func checkNotDeleting(image *buildv1alpha1.Image) error {
+	if image.DeletionTimestamp != nil {
+		return errors.Errorf("image %s in namespace %s is being deleted", image.Name, image.Namespace)
+	}
+	return nil
+}
+
+// triggerPatch is a JSON merge patch from image to triggered. It only carries the annotations,
+// build environment, git revision, and builder a put changes, so changes kpack or anyone else makes
+// to the rest of the image concurrently are neither overwritten nor rejected as conflicts.
+func triggerPatch(image, triggered *buildv1alpha1.Image, triggerAnnotation string) ([]byte, error) {
+	annotations := map[string]interface{}{}
+	for _, key := range []string{triggerAnnotation, putEnvAnnotation} {
+		if key == "" {
+			continue
+		}
+		value, ok := triggered.Annotations[key]
+		switch {
+		case !ok && image.Annotations[key] != "":
+			annotations[key] = nil
+		case ok && value != image.Annotations[key]:
+			annotations[key] = value
+		}
+	}
+
+	patch := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": annotations,
+		},
+	}
+	spec := map[string]interface{}{}
+	if !equality.Semantic.DeepEqual(image.Spec.Build.Env, triggered.Spec.Build.Env) {
+		spec["build"] = map[string]interface{}{
+			"env": triggered.Spec.Build.Env,
+		}
+	}
+	if image.Spec.Source.Git != nil && triggered.Spec.Source.Git != nil &&
+		image.Spec.Source.Git.Revision != triggered.Spec.Source.Git.Revision {
+		spec["source"] = map[string]interface{}{
+			"git": map[string]interface{}{
+				"revision": triggered.Spec.Source.Git.Revision,
+			},
+		}
+	}
+	if image.Spec.Builder.Kind != triggered.Spec.Builder.Kind || image.Spec.Builder.Name != triggered.Spec.Builder.Name {
+		spec["builder"] = map[string]interface{}{
+			"kind": triggered.Spec.Builder.Kind,
+			"name": triggered.Spec.Builder.Name,
+		}
 	}
+	if len(spec) > 0 {
+		patch["spec"] = spec
+	}
+	return json.Marshal(patch)
+}
+
+// setBuilder points the image at the named builder of the given kind, keeping the image's current
+// kind when kind is empty. The builder must exist and be ready, so a put never leaves an image
+// that cannot build. An empty name leaves the image unchanged.
+func setBuilder(client ImageClient, image *buildv1alpha1.Image, kind, name string) error {
+	if name == "" {
+		return nil
+	}
+	if kind != "" {
+		image.Spec.Builder.Kind = kind
+	}
+	image.Spec.Builder.Name = name
+
+	status, err := builderStatus(client, image)
+	if err != nil {
+		return errors.Wrapf(err, "cannot use builder %s", name)
+	}
+	if !status.GetCondition(v1alpha1.ConditionReady).IsTrue() {
+		return errors.Errorf("cannot use builder %s, it is not ready", name)
+	}
+	return nil
+}
 
-	return clientset, k8sClient, nil
+// setSourceRevision points the image's git source at revision, which may be a commit, tag, or
+// branch. An empty revision leaves the image unchanged.
+func setSourceRevision(image *buildv1alpha1.Image, revision string) error {
+	if revision == "" {
+		return nil
+	}
+	if image.Spec.Source.Git == nil {
+		return errors.Errorf("image %s does not build from git, so its revision cannot be set", image.Name)
+	}
+	image.Spec.Source.Git.Revision = revision
+	return nil
+}
+
+// isBuilding reports whether the image's latest build is still running.
+func isBuilding(image *buildv1alpha1.Image, readyCondition string) bool {
+	return image.Status.BuildCounter > 0 && image.Status.GetCondition(v1alpha1.ConditionType(readyCondition)).IsUnknown()
+}
+
+// waitForNewBuild waits until the image's build counter moves past previousBuildCounter and returns
+// the number of the new build.
+func waitForNewBuild(ctx context.Context, client ImageClient, namespace, imageName string,
+	previousBuildCounter int64, poll *pollBackoff, logger *Logger) (int64, error) {
+
+	image, err := waitForImage(ctx, client, namespace, imageName, poll, logger, func(image *buildv1alpha1.Image) (bool, error) {
+		return image.Status.BuildCounter > previousBuildCounter, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return image.Status.BuildCounter, nil
+}
+
+// sleep waits for d, returning early with the context's error if ctx is done first.
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// requestError replaces an API request error caused by a timeout with one that says so.
+func requestError(err error, timeout time.Duration) error {
+	if netErr, ok := errors.Cause(err).(net.Error); ok && netErr.Timeout() {
+		return errors.Errorf("timed out after %s waiting for the API server", timeout)
+	}
+	return err
+}
+
+// waitError describes why Out stopped waiting for what, distinguishing the build timeout from an
+// interrupted resource.
+func waitError(err error, config *Config, what string) error {
+	switch {
+	case err == context.DeadlineExceeded:
+		return errors.Errorf("timed out after %s waiting for %s", config.BuildTimeout, what)
+	case err == context.Canceled:
+		return errors.Wrapf(err, "cancelled waiting for %s", what)
+	default:
+		return err
+	}
+}
+
+// withSignals returns a context that is cancelled when the process receives SIGINT or SIGTERM,
+// which is how Concourse interrupts a resource when its build is aborted.
+func withSignals(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		defer signal.Stop(signals)
+		select {
+		case <-signals:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return ctx, cancel
+}
+
+// readImageManifest loads an image from a YAML or JSON manifest, making sure it describes the
+// image named in source.
+func readImageManifest(path, namespace, imageName string) (*buildv1alpha1.Image, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read image manifest")
+	}
+	defer f.Close()
+
+	image := &buildv1alpha1.Image{}
+	err = yaml.NewYAMLOrJSONDecoder(f, 4096).Decode(image)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse image manifest %s", path)
+	}
+
+	if image.Namespace == "" {
+		image.Namespace = namespace
+	}
+	if image.Namespace != namespace {
+		return nil, errors.Errorf("image manifest namespace %s does not match source namespace %s", image.Namespace, namespace)
+	}
+
+	if image.Name != imageName {
+		return nil, errors.Errorf("image manifest name %s does not match source image %s", image.Name, imageName)
+	}
 
+	return image, nil
 }
@@ -0,0 +1,722 @@
+package resource
+
+import (
+	"encoding/json"
+	oc "github.com/cloudboss/ofcourse/ofcourse"
+	buildv1alpha1 "github.com/pivotal/kpack/pkg/apis/build/v1alpha1"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"knative.dev/pkg/apis/duck/v1alpha1"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTriggerPatch(t *testing.T) {
+	image := &buildv1alpha1.Image{}
+	image.Annotations = map[string]string{"unrelated": "kept"}
+	image.Spec.Build.Env = []corev1.EnvVar{{Name: "BP_JAVA_VERSION", Value: "11"}}
+	now := time.Date(2019, 10, 1, 12, 0, 0, 0, time.UTC)
+
+	t.Run("env var", func(t *testing.T) {
+		triggered := image.DeepCopy()
+		setTrigger(triggered, "", now)
+
+		patch, err := triggerPatch(image, triggered, "")
+		require.NoError(t, err)
+		require.JSONEq(t, `{
+			"metadata": {"annotations": {}},
+			"spec": {"build": {"env": [
+				{"name": "BP_JAVA_VERSION", "value": "11"},
+				{"name": "KPACK_RESOURCE_TRIGGER", "value": "2019-10-01T12:00:00Z"}
+			]}}
+		}`, string(patch))
+	})
+
+	t.Run("configured annotation", func(t *testing.T) {
+		triggered := image.DeepCopy()
+		setTrigger(triggered, "example.com/rebuild", now)
+
+		patch, err := triggerPatch(image, triggered, "example.com/rebuild")
+		require.NoError(t, err)
+		require.JSONEq(t, `{
+			"metadata": {"annotations": {"example.com/rebuild": "2019-10-01T12:00:00Z"}}
+		}`, string(patch))
+	})
+
+	t.Run("builder", func(t *testing.T) {
+		image := image.DeepCopy()
+		image.Spec.Builder.Kind, image.Spec.Builder.Name = "Builder", "old"
+		triggered := image.DeepCopy()
+		triggered.Spec.Builder.Kind, triggered.Spec.Builder.Name = "ClusterBuilder", "new"
+
+		patch, err := triggerPatch(image, triggered, "")
+		require.NoError(t, err)
+		require.JSONEq(t, `{
+			"metadata": {"annotations": {}},
+			"spec": {"builder": {"kind": "ClusterBuilder", "name": "new"}}
+		}`, string(patch))
+	})
+}
+
+func TestCheckNamesTheTrackedKey(t *testing.T) {
+	r := &Resource{}
+	logger := oc.NewLogger(oc.SilentLevel)
+
+	_, err := r.Check(oc.Source{"image": "app"}, oc.Version{"revision": "abc"}, nil, logger)
+	require.EqualError(t, err, `key "ref" not found in version map`)
+
+	_, err = r.Check(oc.Source{"image": "app", "track": "source"}, oc.Version{"ref": "sha256:abc"}, nil, logger)
+	require.EqualError(t, err, `key "revision" not found in version map`)
+}
+
+// testPut runs a put of image app in namespace default against c, polling every millisecond for at
+// most ten seconds and without streaming build logs. source is added to that configuration.
+func testPut(c *fakeImageClient, source oc.Source, params oc.Params) (oc.Version, oc.Metadata, error) {
+	defer useFakeClient(c)()
+
+	putSource := oc.Source{
+		"image":             "app",
+		"namespace":         "default",
+		"log_level":         "silent",
+		"min_poll_interval": "1ms",
+		"poll_interval":     "1ms",
+		"build_timeout":     "10s",
+	}
+	for k, v := range source {
+		putSource[k] = v
+	}
+	return (&Resource{}).Out("", putSource, params, nil, oc.NewLogger(oc.SilentLevel))
+}
+
+func TestOutTimesOut(t *testing.T) {
+	c := newFakeImageClient()
+	build := testBuild(1, "registry/app@sha256:1", "abc")
+	c.addBuilds(build)
+	c.addImage(testImage(build))
+
+	// Nothing completes a build, so the put waits for one to start until it times out.
+	_, _, err := testPut(c, oc.Source{"build_timeout": "20ms"}, oc.Params{})
+	require.EqualError(t, err, "timed out after 20ms waiting for a new build of image app to start")
+
+	c.onPatchImage = func(c *fakeImageClient, image *buildv1alpha1.Image) {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		image = c.images[objectKey("default", "app")]
+		image.Status.BuildCounter = 2
+		image.Status.Conditions[0].Status = corev1.ConditionUnknown
+	}
+	_, _, err = testPut(c, oc.Source{"build_timeout": "20ms"}, oc.Params{})
+	require.EqualError(t, err, "timed out after 20ms waiting for build 2 of image app")
+}
+
+func TestOutReportsFailedBuild(t *testing.T) {
+	c := newFakeImageClient()
+	build := testBuild(1, "registry/app@sha256:1", "abc")
+	c.addBuilds(build)
+	c.addImage(testImage(build))
+	c.onPatchImage = func(c *fakeImageClient, image *buildv1alpha1.Image) {
+		c.completeBuild(testBuild(2, "", "abc"))
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		condition := &c.images[objectKey("default", "app")].Status.Conditions[0]
+		condition.Reason, condition.Message = "BuildFailed", "step build exited with 1"
+	}
+
+	_, _, err := testPut(c, oc.Source{}, oc.Params{})
+	require.EqualError(t, err, "build 2 of image app failed: BuildFailed step build exited with 1")
+
+	// kpack does not always say why a build failed, which is still a failure rather than a timeout.
+	c = newFakeImageClient()
+	c.addBuilds(build)
+	c.addImage(testImage(build))
+	c.onPatchImage = completes(testBuild(2, "", "abc"))
+	_, _, err = testPut(c, oc.Source{}, oc.Params{})
+	require.EqualError(t, err, "build 2 of image app failed")
+}
+
+// completes is an onPatchImage hook that has kpack run build to completion.
+func completes(build buildv1alpha1.Build) func(*fakeImageClient, *buildv1alpha1.Image) {
+	return func(c *fakeImageClient, _ *buildv1alpha1.Image) {
+		c.completeBuild(build)
+	}
+}
+
+func TestOutTriggersRebuild(t *testing.T) {
+	c := newFakeImageClient()
+	first, second := testBuild(1, "registry/app@sha256:1", "abc"), testBuild(2, "registry/app@sha256:2", "abc")
+	c.addBuilds(first)
+	c.addImage(testImage(first))
+	c.onPatchImage = completes(second)
+
+	version, _, err := testPut(c, oc.Source{}, oc.Params{})
+	require.NoError(t, err)
+	require.Equal(t, buildVersion(&second), version)
+
+	// The pinned kpack only rebuilds for a change to the build's config, such as its environment.
+	require.Len(t, c.imagePatches, 1)
+	image, err := c.GetImage("default", "app")
+	require.NoError(t, err)
+	require.Len(t, image.Spec.Build.Env, 1)
+	require.Equal(t, triggerEnvVar, image.Spec.Build.Env[0].Name)
+	require.NotEmpty(t, image.Spec.Build.Env[0].Value)
+}
+
+// testGet runs a get of version of image app in namespace default against c, into a new output
+// directory that the caller removes.
+func testGet(t *testing.T, c *fakeImageClient, version oc.Version, params oc.Params) (string, oc.Version, oc.Metadata, error) {
+	defer useFakeClient(c)()
+
+	dir, err := ioutil.TempDir("", "in")
+	require.NoError(t, err)
+	source := oc.Source{"image": "app", "namespace": "default", "log_level": "silent"}
+	version, metadata, err := (&Resource{}).In(dir, source, params, version, nil, oc.NewLogger(oc.SilentLevel))
+	return dir, version, metadata, err
+}
+
+func TestInWithoutBuild(t *testing.T) {
+	c := newFakeImageClient()
+	c.addImage(testImage())
+
+	for _, version := range []oc.Version{
+		{"ref": "registry/app@sha256:1"},
+		{"ref": "registry/app@sha256:1", "build": "app-build-1-pruned"},
+	} {
+		dir, got, metadata, err := testGet(t, c, version, oc.Params{})
+		defer os.RemoveAll(dir)
+		require.NoError(t, err)
+		require.Equal(t, version, got)
+		require.Empty(t, metadata)
+
+		image, err := ioutil.ReadFile(filepath.Join(dir, "image"))
+		require.NoError(t, err)
+		require.Equal(t, "registry/app@sha256:1", string(image))
+	}
+}
+
+func TestCheckExplainsMissingVersions(t *testing.T) {
+	c := newFakeImageClient()
+	defer useFakeClient(c)()
+	source := oc.Source{"image": "app", "namespace": "default"}
+
+	c.addImage(testImage())
+	var versions []oc.Version
+	var err error
+	stderr := captureStderr(t, func() {
+		versions, err = (&Resource{}).Check(source, nil, nil, oc.NewLogger(oc.InfoLevel))
+	})
+	require.NoError(t, err)
+	require.Empty(t, versions)
+	require.Contains(t, stderr, "image app has not been built yet")
+
+	failed := testBuild(1, "", "abc")
+	c.addBuilds(failed)
+	image := testImage(failed)
+	image.Status.Conditions[0].Reason, image.Status.Conditions[0].Message = "BuildFailed", "step build exited with 1"
+	c.addImage(image)
+	stderr = captureStderr(t, func() {
+		versions, err = (&Resource{}).Check(source, nil, nil, oc.NewLogger(oc.InfoLevel))
+	})
+	require.NoError(t, err)
+	require.Empty(t, versions)
+	require.Contains(t, stderr, "latest build of image app failed: BuildFailed step build exited with 1")
+}
+
+func TestCheckWithoutVersionStartsFromTheImage(t *testing.T) {
+	c := newFakeImageClient()
+	defer useFakeClient(c)()
+	build := testBuild(1, "registry/app@sha256:1", "abc")
+	image := testImage(build)
+	c.addImage(image)
+	logger := oc.NewLogger(oc.SilentLevel)
+
+	// kpack pruned the build, so the version comes from the image.
+	versions, err := (&Resource{}).Check(oc.Source{"image": "app", "namespace": "default"}, nil, nil, logger)
+	require.NoError(t, err)
+	require.Equal(t, []oc.Version{imageVersion(image)}, versions)
+
+	// A build the filters leave out of the history is not a starting point either.
+	c.addBuilds(build)
+	versions, err = (&Resource{}).Check(oc.Source{"image": "app", "namespace": "default", "build_reasons": []interface{}{"STACK"}},
+		nil, nil, logger)
+	require.NoError(t, err)
+	require.Empty(t, versions)
+
+	// An ignored rebuild is passed over for the build before it, and is no starting point by itself.
+	stack := testBuild(2, "registry/app@sha256:2", "abc")
+	stack.Annotations = map[string]string{buildv1alpha1.BuildReasonAnnotation: "STACK"}
+	c.completeBuild(stack)
+	source := oc.Source{"image": "app", "namespace": "default", "ignore_build_reasons": []interface{}{"STACK"}}
+	versions, err = (&Resource{}).Check(source, nil, nil, logger)
+	require.NoError(t, err)
+	require.Equal(t, []oc.Version{buildVersion(&build)}, versions)
+
+	c.mu.Lock()
+	delete(c.builds, objectKey("default", build.Name))
+	c.mu.Unlock()
+	versions, err = (&Resource{}).Check(source, nil, nil, logger)
+	require.NoError(t, err)
+	require.Empty(t, versions)
+}
+
+func TestDeletingImage(t *testing.T) {
+	c := newFakeImageClient()
+	build := testBuild(1, "registry/app@sha256:1", "abc")
+	c.addBuilds(build)
+	image := testImage(build)
+	deleted := v1.NewTime(time.Date(2019, 10, 1, 13, 0, 0, 0, time.UTC))
+	image.DeletionTimestamp = &deleted
+	c.addImage(image)
+
+	func() {
+		defer useFakeClient(c)()
+		_, err := (&Resource{}).Check(oc.Source{"image": "app", "namespace": "default"}, nil, nil, oc.NewLogger(oc.SilentLevel))
+		require.EqualError(t, err, "image app in namespace default is being deleted")
+	}()
+
+	_, _, err := testPut(c, oc.Source{}, oc.Params{})
+	require.EqualError(t, err, "image app in namespace default is being deleted")
+	require.Empty(t, c.imagePatches)
+}
+
+func TestTriggerPatchKeepsConcurrentChanges(t *testing.T) {
+	image := testImage(testBuild(1, "registry/app@sha256:1", "abc"))
+	triggered := image.DeepCopy()
+	setTrigger(triggered, "", time.Now())
+	patch, err := triggerPatch(image, triggered, "")
+	require.NoError(t, err)
+
+	// Someone else changed the image after the put read it, and kpack updated its status.
+	current := image.DeepCopy()
+	current.Annotations = map[string]string{"team": "payments"}
+	current.Spec.Tag = "registry/app-moved"
+	current.Status.BuildCounter = 7
+
+	patched := &buildv1alpha1.Image{}
+	require.NoError(t, mergePatch(current, patch, patched))
+	require.Equal(t, "payments", patched.Annotations["team"])
+	require.Equal(t, "registry/app-moved", patched.Spec.Tag)
+	require.Equal(t, int64(7), patched.Status.BuildCounter)
+	require.Equal(t, triggered.Spec.Build.Env, patched.Spec.Build.Env)
+}
+
+// timeoutError is a net.Error for a request that timed out.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestCheckTimeout(t *testing.T) {
+	c := newFakeImageClient()
+	c.errs["GetImage"] = &url.Error{Op: "Get", URL: "https://dev.example.com", Err: timeoutError{}}
+	var timeout time.Duration
+	connect = func(_ *Logger, _ *Config, t time.Duration) (ImageClient, *kubernetes.Clientset, error) {
+		timeout = t
+		return c, nil, nil
+	}
+	defer func() { connect = getKubeconfig }()
+
+	_, err := (&Resource{}).Check(oc.Source{"image": "app", "namespace": "default", "check_timeout": "20s"}, nil, nil,
+		oc.NewLogger(oc.SilentLevel))
+	require.EqualError(t, err, "timed out after 20s waiting for the API server")
+	require.Equal(t, 20*time.Second, timeout)
+}
+
+func TestCheckDebugLogsImageStatus(t *testing.T) {
+	c := newFakeImageClient()
+	defer useFakeClient(c)()
+	build := testBuild(1, "registry/app@sha256:1", "abc")
+	c.addBuilds(build)
+	c.addImage(testImage(build))
+
+	stderr := captureStderr(t, func() {
+		_, err := (&Resource{}).Check(oc.Source{"image": "app", "namespace": "default", "debug": true}, nil, nil,
+			oc.NewLogger(oc.DebugLevel))
+		require.NoError(t, err)
+	})
+	require.Contains(t, stderr, "status of image app in namespace default:")
+	require.Contains(t, stderr, `"latestImage": "registry/app@sha256:1"`)
+}
+
+func TestInWritesMetadataFile(t *testing.T) {
+	c := newFakeImageClient()
+	build := testBuild(1, "registry/app@sha256:1", "abc")
+	c.addBuilds(build)
+	c.addImage(testImage(build))
+
+	dir, _, metadata, err := testGet(t, c, buildVersion(&build), oc.Params{})
+	defer os.RemoveAll(dir)
+	require.NoError(t, err)
+	require.NotEmpty(t, metadata)
+
+	written, err := ioutil.ReadFile(filepath.Join(dir, "metadata.json"))
+	require.NoError(t, err)
+	var read oc.Metadata
+	require.NoError(t, json.Unmarshal(written, &read))
+	require.Equal(t, metadata, read)
+}
+
+func TestOutAndCheckReturnTheSameVersion(t *testing.T) {
+	first := testBuild(1, "registry/app@sha256:1", "abc")
+	for _, track := range []string{trackImage, trackSource} {
+		c := newFakeImageClient()
+		c.addBuilds(first)
+		c.addImage(testImage(first))
+		c.onPatchImage = completes(testBuild(2, "registry/app@sha256:2", "def"))
+
+		put, _, err := testPut(c, oc.Source{"track": track}, oc.Params{})
+		require.NoError(t, err)
+
+		func() {
+			defer useFakeClient(c)()
+			checked, err := (&Resource{}).Check(oc.Source{"image": "app", "namespace": "default", "track": track},
+				trackedVersion(&first, track), nil, oc.NewLogger(oc.SilentLevel))
+			require.NoError(t, err)
+			require.Equal(t, []oc.Version{put}, checked, track)
+		}()
+	}
+}
+
+func TestOutWaitsForMinBuildNumber(t *testing.T) {
+	c := newFakeImageClient()
+	first, third := testBuild(1, "registry/app@sha256:1", "abc"), testBuild(3, "registry/app@sha256:3", "ghi")
+	c.addBuilds(first)
+	c.addImage(testImage(first))
+	c.onPatchImage = func(c *fakeImageClient, _ *buildv1alpha1.Image) {
+		c.completeBuild(testBuild(2, "registry/app@sha256:2", "def"))
+		go func() {
+			time.Sleep(20 * time.Millisecond)
+			c.completeBuild(third)
+		}()
+	}
+
+	version, _, err := testPut(c, oc.Source{}, oc.Params{"min_build_number": 3})
+	require.NoError(t, err)
+	require.Equal(t, buildVersion(&third), version)
+}
+
+func TestCheckMissingImage(t *testing.T) {
+	c := newFakeImageClient()
+	defer useFakeClient(c)()
+	source := oc.Source{"image": "app", "namespace": "default"}
+
+	_, err := (&Resource{}).Check(source, nil, nil, oc.NewLogger(oc.SilentLevel))
+	require.EqualError(t, err, "image app not found in namespace default")
+
+	source["require_image"] = false
+	var versions []oc.Version
+	stderr := captureStderr(t, func() {
+		versions, err = (&Resource{}).Check(source, nil, nil, oc.NewLogger(oc.InfoLevel))
+	})
+	require.NoError(t, err)
+	require.Empty(t, versions)
+	require.Contains(t, stderr, "image app not found in namespace default")
+}
+
+func TestInWithoutWritingFiles(t *testing.T) {
+	c := newFakeImageClient()
+	build := testBuild(1, "registry/app@sha256:1", "abc")
+	c.addBuilds(build)
+	c.addImage(testImage(build))
+
+	dir, version, metadata, err := testGet(t, c, buildVersion(&build), oc.Params{"write_files": false})
+	defer os.RemoveAll(dir)
+	require.NoError(t, err)
+	require.Equal(t, buildVersion(&build), version)
+	require.NotEmpty(t, metadata)
+
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	require.Empty(t, files)
+}
+
+func TestOutWaitsForTheBuildToStart(t *testing.T) {
+	c := newFakeImageClient()
+	first, running := testBuild(1, "registry/app@sha256:1", "abc"), testBuild(2, "", "abc")
+	running.Status.Conditions[0].Status = corev1.ConditionUnknown
+	c.addBuilds(first)
+	c.addImage(testImage(first))
+	c.onPatchImage = func(c *fakeImageClient, _ *buildv1alpha1.Image) {
+		c.addBuilds(running)
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		image := c.images[objectKey("default", "app")]
+		image.Status.BuildCounter = 2
+		image.Status.Conditions[0].Status = corev1.ConditionUnknown
+	}
+
+	version, metadata, err := testPut(c, oc.Source{}, oc.Params{"wait": "start"})
+	require.NoError(t, err)
+	require.Equal(t, buildVersion(&running), version)
+	require.Contains(t, metadata, oc.NameVal{Name: "buildReason", Value: "UNKNOWN"})
+}
+
+func TestCheckWaitsForPartialStatusToSettle(t *testing.T) {
+	c := newFakeImageClient()
+	defer useFakeClient(c)()
+	first, running := testBuild(1, "registry/app@sha256:1", "abc"), testBuild(2, "", "def")
+	running.Status.Conditions[0].Status = corev1.ConditionUnknown
+	c.addBuilds(running)
+
+	// kpack has started build 2 and reset the condition, but LatestImage is still that of the
+	// pruned build 1.
+	image := testImage(first)
+	image.Status.BuildCounter, image.Status.LatestBuildRef = 2, running.Name
+	image.Status.Conditions[0].Status = corev1.ConditionUnknown
+	c.addImage(image)
+
+	source := oc.Source{"image": "app", "namespace": "default"}
+	versions, err := (&Resource{}).Check(source, nil, nil, oc.NewLogger(oc.SilentLevel))
+	require.NoError(t, err)
+	require.Empty(t, versions)
+
+	second := testBuild(2, "registry/app@sha256:2", "def")
+	c.completeBuild(second)
+	versions, err = (&Resource{}).Check(source, nil, nil, oc.NewLogger(oc.SilentLevel))
+	require.NoError(t, err)
+	require.Equal(t, []oc.Version{buildVersion(&second)}, versions)
+}
+
+func TestCheckReadyCondition(t *testing.T) {
+	c := newFakeImageClient()
+	defer useFakeClient(c)()
+	image := testImage(testBuild(1, "registry/app@sha256:1", "abc"))
+	c.addImage(image)
+	source := oc.Source{"image": "app", "namespace": "default", "ready_condition": "UpToDate"}
+
+	// The image is Ready, but does not have the configured condition yet.
+	versions, err := (&Resource{}).Check(source, nil, nil, oc.NewLogger(oc.SilentLevel))
+	require.NoError(t, err)
+	require.Empty(t, versions)
+
+	image.Status.Conditions = append(image.Status.Conditions,
+		v1alpha1.Condition{Type: "UpToDate", Status: corev1.ConditionTrue})
+	c.addImage(image)
+	versions, err = (&Resource{}).Check(source, nil, nil, oc.NewLogger(oc.SilentLevel))
+	require.NoError(t, err)
+	require.Equal(t, []oc.Version{imageVersion(image)}, versions)
+
+	_, err = parseSource(oc.Source{"image": "app", "ready_condition": "up to date"})
+	require.EqualError(t, err, `source field "ready_condition" must be a condition type such as "Ready"`)
+}
+
+func TestCheckIgnoresOwnTriggers(t *testing.T) {
+	c := newFakeImageClient()
+	first, second := testBuild(1, "registry/app@sha256:1", "abc"), testBuild(2, "registry/app@sha256:2", "abc")
+	c.addBuilds(first)
+	c.addImage(testImage(first))
+	c.onPatchImage = completes(second)
+
+	_, _, err := testPut(c, oc.Source{}, oc.Params{})
+	require.NoError(t, err)
+	require.Contains(t, c.buildPatches, second.Name)
+
+	defer useFakeClient(c)()
+	source := oc.Source{"image": "app", "namespace": "default"}
+	versions, err := (&Resource{}).Check(source, buildVersion(&first), nil, oc.NewLogger(oc.SilentLevel))
+	require.NoError(t, err)
+	require.Equal(t, []oc.Version{buildVersion(&second)}, versions)
+
+	source["ignore_own_triggers"] = true
+	versions, err = (&Resource{}).Check(source, buildVersion(&first), nil, oc.NewLogger(oc.SilentLevel))
+	require.NoError(t, err)
+	require.Empty(t, versions)
+}
+
+func TestOutAnnotatesImageOnSuccess(t *testing.T) {
+	c := newFakeImageClient()
+	first := testBuild(1, "registry/app@sha256:1", "abc")
+	c.addBuilds(first)
+	image := testImage(first)
+	image.Annotations = map[string]string{"team": "payments"}
+	c.addImage(image)
+	c.onPatchImage = completes(testBuild(2, "registry/app@sha256:2", "def"))
+
+	_, _, err := testPut(c, oc.Source{}, oc.Params{"on_success_annotations": map[string]interface{}{"example.com/released": "v1.2.0"}})
+	require.NoError(t, err)
+	annotated, err := c.GetImage("default", "app")
+	require.NoError(t, err)
+	require.Equal(t, "v1.2.0", annotated.Annotations["example.com/released"])
+	require.Equal(t, "payments", annotated.Annotations["team"])
+
+	// A failed build leaves the image unannotated.
+	c = newFakeImageClient()
+	c.addBuilds(first)
+	c.addImage(testImage(first))
+	c.onPatchImage = func(c *fakeImageClient, image *buildv1alpha1.Image) {
+		c.completeBuild(testBuild(2, "", "def"))
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.images[objectKey("default", "app")].Status.Conditions[0].Reason = "BuildFailed"
+	}
+	_, _, err = testPut(c, oc.Source{}, oc.Params{"on_success_annotations": map[string]interface{}{"example.com/released": "v1.2.0"}})
+	require.Error(t, err)
+	failed, err := c.GetImage("default", "app")
+	require.NoError(t, err)
+	require.NotContains(t, failed.Annotations, "example.com/released")
+}
+
+func TestOutNoopBuild(t *testing.T) {
+	first, same := testBuild(1, "registry/app@sha256:1", "abc"), testBuild(2, "registry/app@sha256:1", "abc")
+	newPut := func() *fakeImageClient {
+		c := newFakeImageClient()
+		c.addBuilds(first)
+		c.addImage(testImage(first))
+		c.onPatchImage = completes(same)
+		return c
+	}
+
+	version, _, err := testPut(newPut(), oc.Source{}, oc.Params{})
+	require.NoError(t, err)
+	require.Equal(t, buildVersion(&same), version)
+
+	version, metadata, err := testPut(newPut(), oc.Source{}, oc.Params{"skip_noop": true})
+	require.NoError(t, err)
+	require.Equal(t, buildVersion(&first), version)
+	require.Contains(t, metadata, oc.NameVal{Name: "noop", Value: "true"})
+
+	_, _, err = testPut(newPut(), oc.Source{}, oc.Params{"fail_on_noop": true})
+	require.EqualError(t, err, "build 2 of image app produced the image it already had, registry/app@sha256:1")
+
+	_, err = parseOutParams(oc.Params{"skip_noop": true, "fail_on_noop": true})
+	require.EqualError(t, err, `params fields "fail_on_noop" and "skip_noop" are mutually exclusive`)
+}
+
+func TestCheckTracksSourceResolver(t *testing.T) {
+	c := newFakeImageClient()
+	defer useFakeClient(c)()
+	image := testImage(testBuild(1, "registry/app@sha256:1", "abc"))
+	c.addImage(image)
+	resolver := &buildv1alpha1.SourceResolver{
+		ObjectMeta: v1.ObjectMeta{Name: image.SourceResolverName(), Namespace: "default"},
+	}
+	c.sourceResolvers[objectKey("default", resolver.Name)] = resolver
+	source := oc.Source{"image": "app", "namespace": "default", "track": "sourceresolver"}
+	logger := oc.NewLogger(oc.SilentLevel)
+
+	versions, err := (&Resource{}).Check(source, nil, nil, logger)
+	require.NoError(t, err)
+	require.Empty(t, versions, "not resolved yet")
+
+	// The resolver reports the new revision before any build of it has finished.
+	resolver.Status.Source.Git = &buildv1alpha1.ResolvedGitSource{URL: "https://github.com/example/app", Revision: "def"}
+	versions, err = (&Resource{}).Check(source, oc.Version{"revision": "abc"}, nil, logger)
+	require.NoError(t, err)
+	require.Equal(t, []oc.Version{{"revision": "def"}}, versions)
+
+	versions, err = (&Resource{}).Check(source, oc.Version{"revision": "def"}, nil, logger)
+	require.NoError(t, err)
+	require.Empty(t, versions)
+}
+
+func TestCheckBuildNamespace(t *testing.T) {
+	c := newFakeImageClient()
+	defer useFakeClient(c)()
+	first, second := testBuild(1, "registry/app@sha256:1", "abc"), testBuild(2, "registry/app@sha256:2", "def")
+	first.Namespace, second.Namespace = "builds", "builds"
+	c.addBuilds(first, second)
+	c.addImage(testImage(first, second))
+
+	versions, err := (&Resource{}).Check(oc.Source{"image": "app", "namespace": "default", "build_namespace": "builds"},
+		buildVersion(&first), nil, oc.NewLogger(oc.SilentLevel))
+	require.NoError(t, err)
+	require.Equal(t, []oc.Version{buildVersion(&second)}, versions)
+
+	config := &Config{BuildNamespace: "builds"}
+	require.Equal(t, "builds", config.buildNamespace("default"))
+	require.Equal(t, "default", (&Config{}).buildNamespace("default"))
+
+	require.NoError(t, checkBuildNamespace(c, config))
+	c.errs["ListBuilds"] = notFound("namespaces", "builds")
+	err = checkBuildNamespace(c, config)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "cannot list builds in namespace builds")
+}
+
+func TestCheckWithoutVersionIgnoresOwnTriggers(t *testing.T) {
+	c := newFakeImageClient()
+	triggered := testBuild(1, "registry/app@sha256:1", "abc")
+	triggered.Annotations = map[string]string{putTriggerAnnotation: "true"}
+	c.addBuilds(triggered)
+	c.addImage(testImage(triggered))
+	defer useFakeClient(c)()
+	source := oc.Source{"image": "app", "namespace": "default", "ignore_own_triggers": true}
+
+	versions, err := (&Resource{}).Check(source, nil, nil, oc.NewLogger(oc.SilentLevel))
+	require.NoError(t, err)
+	require.Empty(t, versions)
+
+	delete(source, "ignore_own_triggers")
+	versions, err = (&Resource{}).Check(source, nil, nil, oc.NewLogger(oc.SilentLevel))
+	require.NoError(t, err)
+	require.Equal(t, []oc.Version{buildVersion(&triggered)}, versions)
+}
+
+func TestOutStandaloneBuild(t *testing.T) {
+	c := newFakeImageClient()
+	first := testBuild(1, "registry/app@sha256:1", "abc")
+	c.addBuilds(first)
+	c.addImage(testImage(first))
+	builder := &buildv1alpha1.ClusterBuilder{}
+	builder.Name = "default"
+	builder.Status.LatestImage = "registry/builder@sha256:1"
+	c.clusterBuilders["default"] = builder
+
+	var created *buildv1alpha1.Build
+	c.onCreateBuild = func(c *fakeImageClient, build *buildv1alpha1.Build) {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		created = c.builds[objectKey(build.Namespace, build.Name)]
+		created.Status.LatestImage = "registry/app@sha256:2"
+		created.Status.Conditions = v1alpha1.Conditions{{Type: v1alpha1.ConditionSucceeded, Status: corev1.ConditionTrue}}
+		created.ResourceVersion = c.nextResourceVersion()
+	}
+
+	version, _, err := testPut(c, oc.Source{}, oc.Params{"out_mode": "build"})
+	require.NoError(t, err)
+	require.NotNil(t, created)
+	require.Equal(t, "app-put-", created.GenerateName)
+	require.Equal(t, oc.Version{
+		"ref":          "registry/app@sha256:2",
+		"build":        created.Name,
+		"build_number": "0",
+		"created":      created.CreationTimestamp.UTC().Format(time.RFC3339),
+	}, version)
+	require.Equal(t, buildVersion(created), version)
+	require.Empty(t, c.imagePatches, "the image is left alone")
+}
+
+func TestCheckMissingImageInAllNamespaces(t *testing.T) {
+	c := newFakeImageClient()
+	defer useFakeClient(c)()
+
+	for _, source := range []oc.Source{
+		{"image": "app", "all_namespaces": true},
+		{"images": []interface{}{"app"}, "all_namespaces": true},
+	} {
+		_, err := (&Resource{}).Check(source, nil, nil, oc.NewLogger(oc.SilentLevel))
+		require.EqualError(t, err, "image app not found in all namespaces", source)
+
+		source["require_image"] = false
+		var versions []oc.Version
+		stderr := captureStderr(t, func() {
+			versions, err = (&Resource{}).Check(source, nil, nil, oc.NewLogger(oc.InfoLevel))
+		})
+		require.NoError(t, err, source)
+		require.Empty(t, versions, source)
+		require.Contains(t, stderr, "image app not found in all namespaces", source)
+	}
+
+	_, err := (&Resource{}).Check(oc.Source{"label_selector": "app=web", "namespace": "default"}, nil, nil,
+		oc.NewLogger(oc.SilentLevel))
+	require.EqualError(t, err, `no image matching label_selector "app=web" found in namespace default`)
+}
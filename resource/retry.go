@@ -0,0 +1,85 @@
+package resource
+
+import (
+	utilnet "k8s.io/apimachinery/pkg/util/net"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"syscall"
+	"time"
+)
+
+// retryTransport retries Kubernetes API requests that fail for transient reasons, such as a reset
+// connection or a 429/5xx response, backing off exponentially between attempts. Creates are not
+// retried since the first attempt may have succeeded before the connection failed, and errors such
+// as NotFound or validation failures are always returned immediately.
+type retryTransport struct {
+	next    http.RoundTripper
+	retries int
+	backoff time.Duration
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	delay := t.backoff
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 && req.Body != nil && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req.Body = body
+		}
+
+		resp, err := t.next.RoundTrip(req)
+		if attempt >= t.retries || !retriable(req, resp, err) {
+			return resp, err
+		}
+
+		if resp != nil {
+			resp.Body.Close()
+		}
+
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// retriable reports whether a request failed transiently and is safe to send again.
+func retriable(req *http.Request, resp *http.Response, err error) bool {
+	if req.Method == http.MethodPost || (req.Body != nil && req.GetBody == nil) {
+		return false
+	}
+
+	if err != nil {
+		return utilnet.IsConnectionReset(err) || utilnet.IsProbableEOF(err) || isConnectionRefused(err)
+	}
+
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	default:
+		return false
+	}
+}
+
+// isConnectionRefused reports whether err is a "connection refused" error, which the API server
+// returns while it restarts. It unwraps err the way utilnet.IsConnectionReset does.
+func isConnectionRefused(err error) bool {
+	if urlErr, ok := err.(*url.Error); ok {
+		err = urlErr.Err
+	}
+	if opErr, ok := err.(*net.OpError); ok {
+		err = opErr.Err
+	}
+	if osErr, ok := err.(*os.SyscallError); ok {
+		err = osErr.Err
+	}
+	errno, ok := err.(syscall.Errno)
+	return ok && errno == syscall.ECONNREFUSED
+}
@@ -0,0 +1,79 @@
+package resource
+
+import (
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// failingServer answers its first failures requests with status and the rest with 200, counting
+// the requests it receives.
+func failingServer(failures, status int) (*httptest.Server, *int) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests <= failures {
+			w.WriteHeader(status)
+		}
+	}))
+	return server, &requests
+}
+
+func TestRetryTransport(t *testing.T) {
+	client := &http.Client{Transport: &retryTransport{next: http.DefaultTransport, retries: 3, backoff: time.Millisecond}}
+
+	server, requests := failingServer(2, http.StatusServiceUnavailable)
+	defer server.Close()
+	resp, err := client.Get(server.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, 3, *requests)
+
+	server, requests = failingServer(5, http.StatusTooManyRequests)
+	defer server.Close()
+	resp, err = client.Get(server.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	require.Equal(t, 4, *requests)
+
+	server, requests = failingServer(1, http.StatusNotFound)
+	defer server.Close()
+	resp, err = client.Get(server.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	require.Equal(t, 1, *requests)
+
+	// A create may have happened before the failure, so it is never sent twice.
+	server, requests = failingServer(1, http.StatusServiceUnavailable)
+	defer server.Close()
+	resp, err = client.Post(server.URL, "application/json", strings.NewReader("{}"))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	require.Equal(t, 1, *requests)
+
+	// A patch is resent with its body.
+	var bodies []string
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		bodies = append(bodies, string(body))
+		if len(bodies) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer server.Close()
+	req, err := http.NewRequest(http.MethodPatch, server.URL, strings.NewReader(`{"a":1}`))
+	require.NoError(t, err)
+	resp, err = client.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, []string{`{"a":1}`, `{"a":1}`}, bodies)
+}
@@ -0,0 +1,162 @@
+package resource
+
+import (
+	"context"
+	"fmt"
+	oc "github.com/cloudboss/ofcourse/ofcourse"
+	buildv1alpha1 "github.com/pivotal/kpack/pkg/apis/build/v1alpha1"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"knative.dev/pkg/apis/duck/v1alpha1"
+	"sort"
+)
+
+// standaloneBuildImageLabel names the image a one-off Build was created from. kpack's own image
+// label is deliberately not used, so the build does not become part of the image's build history.
+const standaloneBuildImageLabel = "kpack-resource/image"
+
+// runStandaloneBuild creates a one-off Build from image's current spec and waits for it to finish,
+// leaving the Image itself untouched. The build's logs are written once it completes.
+func runStandaloneBuild(config *Config, outParams *OutParams, client ImageClient, k8sClient *kubernetes.Clientset,
+	image *buildv1alpha1.Image, logger *Logger) (oc.Version, oc.Metadata, error) {
+
+	status, err := builderStatus(client, image)
+	if err != nil {
+		err = errors.Wrapf(err, "failed to look up the builder of image %s", image.Name)
+		logger.Errorf(err.Error())
+		return nil, nil, err
+	}
+	if status.LatestImage == "" {
+		err := errors.Errorf("builder %s of image %s has no image yet", image.Spec.Builder.Name, image.Name)
+		logger.Errorf(err.Error())
+		return nil, nil, err
+	}
+
+	build := newStandaloneBuild(image, status.LatestImage, outParams.Env)
+	if outParams.DryRun {
+		logger.Infof("dry run: would create a build of image %s in namespace %s", image.Name, image.Namespace)
+		return oc.Version{}, oc.Metadata{}, nil
+	}
+
+	build, err = client.CreateBuild(build)
+	if err != nil {
+		logger.Errorf(err.Error())
+		return nil, nil, err
+	}
+	logger.Infof("created build %s", build.Name)
+
+	ctx, stop := withSignals(context.Background())
+	defer stop()
+	ctx, cancel := context.WithTimeout(ctx, config.BuildTimeout)
+	defer cancel()
+
+	poll := newPollBackoff(config.MinPollInterval, config.PollInterval)
+	resourceVersion := build.ResourceVersion
+	for {
+		if err := poll.wait(ctx); err != nil {
+			if err == context.Canceled && outParams.CancelOnAbort {
+				if err := client.DeleteBuild(build.Namespace, build.Name); err != nil {
+					logger.Warnf("could not cancel build %s: %s", build.Name, err)
+				} else {
+					logger.Infof("cancelled build %s", build.Name)
+				}
+			}
+			err = waitError(err, config, fmt.Sprintf("build %s", build.Name))
+			logger.Errorf(err.Error())
+			return nil, nil, err
+		}
+
+		build, err = client.GetBuild(build.Namespace, build.Name)
+		if err != nil {
+			logger.Errorf(err.Error())
+			return nil, nil, err
+		}
+		if build.ResourceVersion != resourceVersion {
+			resourceVersion = build.ResourceVersion
+			poll.reset()
+		}
+
+		succeeded := build.Status.GetCondition(v1alpha1.ConditionSucceeded)
+		if !succeeded.IsTrue() && !succeeded.IsFalse() {
+			continue
+		}
+
+		if build.Status.PodName != "" && streamsBuildLogs(config.LogLevel) {
+			pod, err := k8sClient.CoreV1().Pods(build.Namespace).Get(build.Status.PodName, v1.GetOptions{})
+			if err == nil {
+				w := newLogInfoWriter(logger.Logger, config.LogLevel)
+				err = writeBuildLogs(k8sClient, pod, w)
+				w.Close()
+			}
+			if err != nil {
+				logger.Warnf("could not read logs of build %s: %s", build.Name, err)
+			}
+		}
+
+		if succeeded.IsFalse() {
+			err := errors.Errorf("build %s of image %s failed: %s %s", build.Name, image.Name, succeeded.Reason, succeeded.Message)
+			logger.Errorf(err.Error())
+			return nil, nil, err
+		}
+
+		metadata := sourceMetadata(build.Spec.Source)
+		metadata = append(metadata, imageRefMetadata(splitImageRef(build.Status.LatestImage))...)
+		metadata = append(metadata, buildMetadata(build)...)
+		metadata = append(metadata, resolvedRevisionMetadata(build, image.Spec.Source)...)
+		builder, err := builderMetadata(client, image)
+		if err != nil {
+			logger.Warnf("could not look up builder: %s", err)
+		}
+		metadata = append(metadata, builder...)
+		metadata = append(metadata, requestedRevisionMetadata(outParams.SourceRevision)...)
+
+		return buildVersion(build), renameMetadata(metadata, config.MetadataKeys), nil
+	}
+}
+
+// newStandaloneBuild describes a Build of image's spec with the given builder image. env is added
+// to the image's own build environment, overriding variables of the same name.
+func newStandaloneBuild(image *buildv1alpha1.Image, builderImage string, env map[string]string) *buildv1alpha1.Build {
+	var buildEnv []corev1.EnvVar
+	for _, envVar := range image.Spec.Build.Env {
+		if _, ok := env[envVar.Name]; !ok {
+			buildEnv = append(buildEnv, envVar)
+		}
+	}
+	names := make([]string, 0, len(env))
+	for name := range env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		buildEnv = append(buildEnv, corev1.EnvVar{Name: name, Value: env[name]})
+	}
+
+	return &buildv1alpha1.Build{
+		ObjectMeta: v1.ObjectMeta{
+			GenerateName: image.Name + "-put-",
+			Namespace:    image.Namespace,
+			Labels: map[string]string{
+				standaloneBuildImageLabel: image.Name,
+			},
+			OwnerReferences: []v1.OwnerReference{
+				{
+					APIVersion: buildv1alpha1.SchemeGroupVersion.String(),
+					Kind:       "Image",
+					Name:       image.Name,
+					UID:        image.UID,
+				},
+			},
+		},
+		Spec: buildv1alpha1.BuildSpec{
+			Tags:           []string{image.Spec.Tag},
+			Builder:        buildv1alpha1.BuildBuilderSpec{Image: builderImage},
+			ServiceAccount: image.Spec.ServiceAccount,
+			Source:         image.Spec.Source,
+			Env:            buildEnv,
+			Resources:      image.Spec.Build.Resources,
+		},
+	}
+}
@@ -0,0 +1,39 @@
+package resource
+
+import (
+	buildv1alpha1 "github.com/pivotal/kpack/pkg/apis/build/v1alpha1"
+	"knative.dev/pkg/apis/duck/v1alpha1"
+)
+
+// imageReadiness reports whether image's ready condition, Ready unless the `ready_condition` source
+// field names another, is true, along with the reason and message kpack gave for it. Both are empty
+// when the image does not have the condition yet.
+func imageReadiness(image *buildv1alpha1.Image, readyCondition string) (ready bool, reason, message string) {
+	condition := image.Status.GetCondition(v1alpha1.ConditionType(readyCondition))
+	if condition == nil {
+		return false, "", ""
+	}
+	return condition.IsTrue(), condition.Reason, condition.Message
+}
+
+// imageSettled reports whether image's latest build has finished successfully, so its LatestImage
+// can be reported: the image is ready, and the build LatestBuildRef names has succeeded. kpack
+// updates the image and the build separately, so one may briefly lag the other. A build that has
+// been pruned from history is trusted to have succeeded.
+func imageSettled(image *buildv1alpha1.Image, history []buildv1alpha1.Build, readyCondition string) bool {
+	if ready, _, _ := imageReadiness(image, readyCondition); !ready || image.Status.LatestImage == "" {
+		return false
+	}
+	for _, build := range history {
+		if build.Name == image.Status.LatestBuildRef {
+			return build.Status.GetCondition(v1alpha1.ConditionSucceeded).IsTrue()
+		}
+	}
+	return true
+}
+
+// imageFailed reports whether image's ready condition is false, which kpack sets when the latest
+// build failed. A missing or unknown condition means the image has not finished building.
+func imageFailed(image *buildv1alpha1.Image, readyCondition string) bool {
+	return image.Status.GetCondition(v1alpha1.ConditionType(readyCondition)).IsFalse()
+}
@@ -0,0 +1,42 @@
+package resource
+
+import (
+	buildv1alpha1 "github.com/pivotal/kpack/pkg/apis/build/v1alpha1"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	"knative.dev/pkg/apis/duck/v1alpha1"
+	"testing"
+)
+
+func TestImageReadiness(t *testing.T) {
+	image := testImage()
+	ready, reason, message := imageReadiness(image, defaultReadyCondition)
+	require.False(t, ready)
+	require.Empty(t, reason)
+	require.Empty(t, message)
+	require.False(t, imageFailed(image, defaultReadyCondition))
+
+	image.Status.Conditions = v1alpha1.Conditions{{
+		Type: v1alpha1.ConditionReady, Status: corev1.ConditionFalse, Reason: "BuildFailed", Message: "exit 1",
+	}}
+	ready, reason, message = imageReadiness(image, defaultReadyCondition)
+	require.False(t, ready)
+	require.Equal(t, "BuildFailed", reason)
+	require.Equal(t, "exit 1", message)
+	require.True(t, imageFailed(image, defaultReadyCondition))
+}
+
+func TestImageSettled(t *testing.T) {
+	build := testBuild(1, "registry/app@sha256:1", "abc")
+	image := testImage(build)
+	require.True(t, imageSettled(image, []buildv1alpha1.Build{build}, defaultReadyCondition))
+	require.True(t, imageSettled(image, nil, defaultReadyCondition), "pruned builds are trusted")
+
+	// kpack has marked the image ready before the build.
+	running := build.DeepCopy()
+	running.Status.Conditions[0].Status = corev1.ConditionUnknown
+	require.False(t, imageSettled(image, []buildv1alpha1.Build{*running}, defaultReadyCondition))
+
+	image.Status.Conditions[0].Status = corev1.ConditionUnknown
+	require.False(t, imageSettled(image, []buildv1alpha1.Build{build}, defaultReadyCondition))
+}
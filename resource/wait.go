@@ -0,0 +1,190 @@
+package resource
+
+import (
+	"context"
+	buildv1alpha1 "github.com/pivotal/kpack/pkg/apis/build/v1alpha1"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"knative.dev/pkg/apis/duck/v1alpha1"
+	"time"
+)
+
+// waitForImage waits until done accepts the named image or returns an error, and returns the
+// accepted image. The image is watched so changes are seen as soon as they happen; when watching is
+// not permitted, or a watch ends, the image is polled instead, backing off while it does not change.
+func waitForImage(ctx context.Context, client ImageClient, namespace, name string, poll *pollBackoff,
+	logger *Logger, done func(*buildv1alpha1.Image) (bool, error)) (*buildv1alpha1.Image, error) {
+
+	watchable := true
+	resourceVersion := ""
+	for {
+		image, err := client.GetImage(namespace, name)
+		if err != nil {
+			return nil, err
+		}
+		if image.ResourceVersion != resourceVersion {
+			resourceVersion = image.ResourceVersion
+			poll.reset()
+		}
+		if ok, err := acceptImage(image, done); ok || err != nil {
+			return image, err
+		}
+
+		if watchable {
+			w, err := client.WatchImages(namespace, v1.ListOptions{
+				FieldSelector:   fields.OneTermEqualSelector("metadata.name", name).String(),
+				ResourceVersion: image.ResourceVersion,
+			})
+			switch {
+			case k8serrors.IsForbidden(err):
+				logger.Debugf("not allowed to watch image %s, polling instead", name)
+				watchable = false
+			case err != nil:
+				return nil, err
+			default:
+				image, err := watchUntil(ctx, w, done)
+				w.Stop()
+				if image != nil || err != nil {
+					return image, err
+				}
+			}
+		}
+
+		if err := poll.wait(ctx); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// pollBackoff spaces out the reads of an object that is polled for a change. The first wait is min
+// and each one after it doubles, up to max, until reset is called because the object changed. This
+// notices the quick early steps of a build promptly without reading a long build every second.
+type pollBackoff struct {
+	min, max, next time.Duration
+}
+
+func newPollBackoff(min, max time.Duration) *pollBackoff {
+	return &pollBackoff{min: min, max: max, next: min}
+}
+
+// wait sleeps for the current interval and lengthens the next one.
+func (b *pollBackoff) wait(ctx context.Context) error {
+	d := b.next
+	b.next *= 2
+	if b.next > b.max {
+		b.next = b.max
+	}
+	return sleep(ctx, d)
+}
+
+// reset starts the backoff again from min.
+func (b *pollBackoff) reset() {
+	b.next = b.min
+}
+
+// watchUntil returns the first image from w that done accepts. It returns nil without an error
+// when the watch ends first.
+func watchUntil(ctx context.Context, w watch.Interface,
+	done func(*buildv1alpha1.Image) (bool, error)) (*buildv1alpha1.Image, error) {
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case event, ok := <-w.ResultChan():
+			if !ok || event.Type == watch.Error {
+				return nil, nil
+			}
+
+			image, ok := event.Object.(*buildv1alpha1.Image)
+			if !ok {
+				continue
+			}
+			if ok, err := acceptImage(image, done); ok || err != nil {
+				return image, err
+			}
+		}
+	}
+}
+
+func acceptImage(image *buildv1alpha1.Image, done func(*buildv1alpha1.Image) (bool, error)) (bool, error) {
+	if err := checkNotDeleting(image); err != nil {
+		return false, err
+	}
+	return done(image)
+}
+
+// waitForScheduling waits until the pod of the numbered build has been scheduled onto a node, or
+// the build has finished. Once the scheduler has been unable to place the pod for longer than
+// timeout, it fails with the scheduler's explanation, e.g. that the cluster lacks the cpu the build
+// requests. Without permission to read pods it does not wait.
+func waitForScheduling(ctx context.Context, client ImageClient, k8sClient *kubernetes.Clientset, namespace, imageName string,
+	number int64, timeout time.Duration, poll *pollBackoff, logger *Logger) error {
+
+	deadline := time.Now().Add(timeout)
+	warned := false
+	resourceVersion := ""
+	for {
+		build, err := getNumberedBuild(client, namespace, imageName, number)
+		if err != nil {
+			return err
+		}
+		if build != nil && build.ResourceVersion != resourceVersion {
+			resourceVersion = build.ResourceVersion
+			poll.reset()
+		}
+		if build != nil && !build.Status.GetCondition(v1alpha1.ConditionSucceeded).IsUnknown() {
+			return nil
+		}
+
+		if build != nil && build.Status.PodName != "" {
+			pod, err := k8sClient.CoreV1().Pods(namespace).Get(build.Status.PodName, v1.GetOptions{})
+			switch {
+			case k8serrors.IsForbidden(err):
+				logger.Debugf("not allowed to read pod %s, not waiting for it to be scheduled", build.Status.PodName)
+				return nil
+			case k8serrors.IsNotFound(err):
+			case err != nil:
+				return err
+			default:
+				scheduled, message := podScheduled(pod)
+				if scheduled {
+					return nil
+				}
+				if message != "" && time.Now().After(deadline) {
+					return errors.Errorf("build pod %s pending: %s", pod.Name, message)
+				}
+				if message != "" && !warned {
+					logger.Warnf("build pod %s cannot be scheduled yet: %s", pod.Name, message)
+					warned = true
+				}
+			}
+		}
+
+		if err := poll.wait(ctx); err != nil {
+			return err
+		}
+	}
+}
+
+// podScheduled reports whether pod has been placed on a node and, when the scheduler could not
+// place it, why not.
+func podScheduled(pod *corev1.Pod) (bool, string) {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type != corev1.PodScheduled {
+			continue
+		}
+		if condition.Status == corev1.ConditionTrue {
+			return true, ""
+		}
+		if condition.Reason == corev1.PodReasonUnschedulable {
+			return false, condition.Message
+		}
+	}
+	return false, ""
+}
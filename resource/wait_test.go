@@ -0,0 +1,114 @@
+package resource
+
+import (
+	"context"
+	"encoding/json"
+	oc "github.com/cloudboss/ofcourse/ofcourse"
+	buildv1alpha1 "github.com/pivotal/kpack/pkg/apis/build/v1alpha1"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWaitForImageWatches(t *testing.T) {
+	c := newFakeImageClient()
+	c.addImage(testImage())
+	c.watcher = watch.NewFake()
+	built := testImage(testBuild(1, "registry/app@sha256:1", "abc"))
+	go c.watcher.Modify(built)
+
+	// Polling would not look again before the test times out, so the image must come from the watch.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	image, err := waitForImage(ctx, c, "default", "app", newPollBackoff(time.Hour, time.Hour),
+		newLogger(oc.NewLogger(oc.SilentLevel), &Config{}), func(image *buildv1alpha1.Image) (bool, error) {
+			return image.Status.LatestImage != "", nil
+		})
+	require.NoError(t, err)
+	require.Equal(t, "registry/app@sha256:1", image.Status.LatestImage)
+}
+
+func TestWaitForImagePollsWithoutWatchPermission(t *testing.T) {
+	c := newFakeImageClient()
+	c.addImage(testImage())
+	c.errs["WatchImages"] = k8serrors.NewForbidden(schema.GroupResource{Resource: "images"}, "", nil)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		c.completeBuild(testBuild(1, "registry/app@sha256:1", "abc"))
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	image, err := waitForImage(ctx, c, "default", "app", newPollBackoff(time.Millisecond, time.Millisecond),
+		newLogger(oc.NewLogger(oc.SilentLevel), &Config{}), func(image *buildv1alpha1.Image) (bool, error) {
+			return image.Status.LatestImage != "", nil
+		})
+	require.NoError(t, err)
+	require.Equal(t, "registry/app@sha256:1", image.Status.LatestImage)
+}
+
+// podServer serves pod as every pod of an API server, and a clientset for it.
+func podServer(t *testing.T, pod *corev1.Pod) (*httptest.Server, *kubernetes.Clientset) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		require.NoError(t, json.NewEncoder(w).Encode(pod))
+	}))
+	k8sClient, err := kubernetes.NewForConfig(&rest.Config{Host: server.URL})
+	require.NoError(t, err)
+	return server, k8sClient
+}
+
+func TestWaitForScheduling(t *testing.T) {
+	c := newFakeImageClient()
+	running := testBuild(1, "", "abc")
+	running.Status.Conditions[0].Status = corev1.ConditionUnknown
+	running.Status.PodName = "app-build-1-abcde-build-pod"
+	c.addBuilds(running)
+	logger := newLogger(oc.NewLogger(oc.SilentLevel), &Config{})
+	poll := newPollBackoff(time.Millisecond, time.Millisecond)
+
+	pod := &corev1.Pod{}
+	pod.Kind, pod.APIVersion, pod.Name = "Pod", "v1", running.Status.PodName
+	pod.Status.Conditions = []corev1.PodCondition{{
+		Type:    corev1.PodScheduled,
+		Status:  corev1.ConditionFalse,
+		Reason:  corev1.PodReasonUnschedulable,
+		Message: "0/3 nodes are available: 3 Insufficient cpu.",
+	}}
+	server, k8sClient := podServer(t, pod)
+	defer server.Close()
+	err := waitForScheduling(context.Background(), c, k8sClient, "default", "app", 1, 0, poll, logger)
+	require.EqualError(t, err, "build pod app-build-1-abcde-build-pod pending: 0/3 nodes are available: 3 Insufficient cpu.")
+
+	pod.Status.Conditions[0].Status, pod.Status.Conditions[0].Reason = corev1.ConditionTrue, ""
+	server, k8sClient = podServer(t, pod)
+	defer server.Close()
+	require.NoError(t, waitForScheduling(context.Background(), c, k8sClient, "default", "app", 1, 0, poll, logger))
+}
+
+func TestPollBackoff(t *testing.T) {
+	poll := newPollBackoff(time.Millisecond, 5*time.Millisecond)
+	var waits []time.Duration
+	for i := 0; i < 5; i++ {
+		waits = append(waits, poll.next)
+		require.NoError(t, poll.wait(context.Background()))
+	}
+	require.Equal(t, []time.Duration{
+		time.Millisecond, 2 * time.Millisecond, 4 * time.Millisecond, 5 * time.Millisecond, 5 * time.Millisecond,
+	}, waits)
+
+	poll.reset()
+	require.Equal(t, time.Millisecond, poll.next)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.Equal(t, context.Canceled, newPollBackoff(time.Minute, time.Minute).wait(ctx))
+}